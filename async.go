@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+)
+
+// createJob is a queued CRD creation along with the ID of the request that
+// asked for it, so the worker's logs can be tied back to it
+type createJob struct {
+	req       crdRequest
+	namespace string
+	requestID string
+}
+
+// asyncCreator creates CRDs in the background on a fixed pool of workers fed
+// from a bounded queue
+type asyncCreator struct {
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	store         *configStore
+	queue         chan createJob
+	group         *singleflight.Group
+	wg            sync.WaitGroup
+}
+
+// newAsyncCreator starts workers creating CRDs through group, which should be
+// the one synchronous creates go through, so a queued create and a request
+// for the same object still make one API call
+func newAsyncCreator(dynamicClient dynamic.Interface, recorder record.EventRecorder, store *configStore, group *singleflight.Group, workers, queueSize int) *asyncCreator {
+	creator := &asyncCreator{
+		dynamicClient: dynamicClient,
+		recorder:      recorder,
+		store:         store,
+		group:         group,
+		queue:         make(chan createJob, queueSize),
+	}
+
+	creator.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go creator.work()
+	}
+	return creator
+}
+
+// enqueue queues a job without blocking, returning false if the queue is full
+func (c *asyncCreator) enqueue(job createJob) bool {
+	select {
+	case c.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops accepting jobs and waits for the queued ones to finish.
+// Nothing may be enqueued once it has been called.
+func (c *asyncCreator) shutdown() {
+	close(c.queue)
+	c.wg.Wait()
+}
+
+func (c *asyncCreator) work() {
+	defer c.wg.Done()
+
+	for job := range c.queue {
+		c.create(job)
+	}
+}
+
+func (c *asyncCreator) create(job createJob) {
+	// The request that queued the job is long gone, so the API calls get
+	// their own deadline
+	config := c.store.get()
+	config.Namespace = job.namespace
+	ctx := context.WithValue(context.Background(), requestIDContextKey{}, job.requestID)
+	ctx, cancel := context.WithTimeout(ctx, config.K8sTimeout)
+	defer cancel()
+
+	logger := slog.With("ip", job.req.IPAddress, "hostname", job.req.Hostname, "name", objectName(config, job.req.SvcFriendlyIp))
+
+	_, created, err := createCRDOnce(ctx, c.group, c.dynamicClient, c.recorder, config, job.req)
+	if err != nil && ctx.Err() != nil {
+		crdFailuresTotal.MustCurryWith(crdMetricLabels(config)).WithLabelValues("timeout").Inc()
+		logger.ErrorContext(ctx, "Timed out creating CRD asynchronously", "outcome", "timeout", "error", err)
+		return
+	}
+	if err != nil {
+		crdFailuresTotal.MustCurryWith(crdMetricLabels(config)).WithLabelValues("api_error").Inc()
+		logger.ErrorContext(ctx, "Failed to create CRD asynchronously", "outcome", "api_error", "error", err)
+		return
+	}
+
+	status := "updated"
+	if created {
+		status = "created"
+	}
+	logger.InfoContext(ctx, "Handled queued CRD request", "outcome", status)
+}
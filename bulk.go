@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// bulkWorkers bounds how many entries of a bulk request are created at once
+const bulkWorkers = 4
+
+// bulkEntry is one object to create in a bulk request, given either as a
+// hostname like those in the Host header or as a bare IP
+type bulkEntry struct {
+	Hostname string `json:"hostname,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+type bulkResult struct {
+	Hostname  string `json:"hostname,omitempty"`
+	IPAddress string `json:"ipAddress,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// bulkCreator creates the IcanhazlbServices for bulk requests with the
+// default settings, applying the same checks as single requests
+type bulkCreator struct {
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	group         *singleflight.Group
+}
+
+// create creates the objects for entries on a bounded pool of workers,
+// returning a result for each entry in the same order
+func (b *bulkCreator) create(ctx context.Context, config Config, entries []bulkEntry, createdBy string) []bulkResult {
+	results := make([]bulkResult, len(entries))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(bulkWorkers, len(entries)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results[index] = b.createEntry(ctx, config, entries[index], createdBy)
+			}
+		}()
+	}
+
+	for index := range entries {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+func (b *bulkCreator) createEntry(ctx context.Context, config Config, entry bulkEntry, createdBy string) bulkResult {
+	failures := crdFailuresTotal.MustCurryWith(crdMetricLabels(config))
+	result := bulkResult{Hostname: entry.Hostname, Status: "error"}
+
+	// Bare IPs get the hostname an /ip/ request for them would have
+	hostname := entry.Hostname
+	if hostname == "" {
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			result.Error = fmt.Sprintf("invalid entry: needs a hostname or a valid ip, got %q", entry.IP)
+			return result
+		}
+		hostname = bareHostname(ip.String(), config.BaseDomain)
+		result.Hostname = hostname
+	}
+
+	if err := checkHostnameLimits(config, hostname); err != nil {
+		failures.WithLabelValues("invalid_hostname").Inc()
+		result.Error = err.Error()
+		return result
+	}
+
+	if config.BaseDomain != "" && !hostnameInDomain(hostname, config.BaseDomain) {
+		failures.WithLabelValues("forbidden_host").Inc()
+		result.Error = fmt.Sprintf("hostname %q is not under %s", hostname, config.BaseDomain)
+		return result
+	}
+
+	ipAddress, err := parseIPAddressFromHostname(hostname, config.IPLabelPosition)
+	if err != nil {
+		failures.WithLabelValues("invalid_hostname").Inc()
+		result.Error = err.Error()
+		return result
+	}
+	result.IPAddress = ipAddress
+
+	if config.namespaceRegex != nil {
+		namespace, err := namespaceFromHostname(config.namespaceRegex, hostname)
+		if err != nil {
+			failures.WithLabelValues("invalid_namespace").Inc()
+			result.Error = err.Error()
+			return result
+		}
+		if namespace != "" {
+			config.Namespace = namespace
+		}
+	}
+
+	if !config.AllowSpecialIPs {
+		if err := checkSpecialIP(net.ParseIP(ipAddress)); err != nil {
+			failures.WithLabelValues("special_ip").Inc()
+			result.Error = err.Error()
+			return result
+		}
+	}
+	if err := checkIPAllowed(net.ParseIP(ipAddress), config.allowNets, config.denyNets); err != nil {
+		failures.WithLabelValues("forbidden_ip").Inc()
+		result.Error = err.Error()
+		return result
+	}
+
+	ingFriendlyHostname := strings.ReplaceAll(hostname, "_", "-")
+	var bareHost string
+	if config.CollapseSubdomains {
+		ingFriendlyHostname, bareHost = collapseSubdomains(ingFriendlyHostname)
+	}
+	svcFriendlyIp := strings.NewReplacer(".", "-", ":", "-").Replace(ipAddress)
+	result.Name = objectName(config, svcFriendlyIp)
+	result.Namespace = config.Namespace
+	if err := validateObjectName(result.Name); err != nil {
+		failures.WithLabelValues("invalid_hostname").Inc()
+		result.Error = err.Error()
+		return result
+	}
+
+	ports := configuredDefaultPorts(config)
+	if hostPort := parsePortFromHostname(ctx, hostnameForIP(hostname, config.IPLabelPosition)); hostPort != 0 {
+		ports[0].Port = hostPort
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.K8sTimeout)
+	defer cancel()
+
+	if config.MaxServices > 0 {
+		if _, err := checkServiceLimit(ctx, b.dynamicClient, config, result.Name); err != nil {
+			reason := "api_error"
+			if errors.Is(err, errServiceLimitReached) {
+				reason = "limit_reached"
+			}
+			failures.WithLabelValues(reason).Inc()
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	if config.CreateNamespace {
+		if err := ensureNamespace(ctx, b.clientset, config.Namespace); err != nil {
+			failures.WithLabelValues("api_error").Inc()
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	// The headless setting was checked against the service type on load
+	clusterIP, _ := parseClusterIP("", config.Headless, config.ServiceType)
+
+	_, created, err := createCRDOnce(ctx, b.group, b.dynamicClient, b.recorder, config, crdRequest{
+		IPAddress:     ipAddress,
+		Hostname:      ingFriendlyHostname,
+		Aliases:       withBareHost(nil, bareHost),
+		SvcFriendlyIp: svcFriendlyIp,
+		Ports:         ports,
+		Addresses:     []string{ipAddress},
+		CreatedBy:     createdBy,
+		Conditions:    IcanhazlbEndpointConditions{Ready: true, Serving: true},
+		NoIngress:     !config.CreateIngress,
+		ClusterIP:     clusterIP,
+	})
+	if err != nil {
+		reason := "api_error"
+		if ctx.Err() != nil {
+			reason = "timeout"
+		}
+		failures.WithLabelValues(reason).Inc()
+		slog.ErrorContext(ctx, "Failed to create CRD in bulk request", "hostname", hostname, "outcome", reason, "error", err)
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Status = "updated"
+	if created {
+		result.Status = "created"
+	}
+	return result
+}
+
+// serveHTTP handles POST /bulk with a JSON array of entries
+func (b *bulkCreator) serveHTTP(w http.ResponseWriter, r *http.Request, config Config) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var entries []bulkEntry
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		writeJSONError(w, fmt.Sprintf("Invalid bulk request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(entries) == 0 {
+		writeJSONError(w, "Bulk request has no entries", http.StatusBadRequest)
+		return
+	}
+	// The rate limiter only charges the request once, so the entries it
+	// can create are bounded here instead
+	if config.BulkMaxEntries > 0 && len(entries) > config.BulkMaxEntries {
+		writeJSONError(w, fmt.Sprintf("Bulk request has %d entries, more than the maximum of %d", len(entries), config.BulkMaxEntries), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := b.create(r.Context(), config, entries, requestingClient(r, config.TrustForwardedHeaders))
+
+	succeeded := 0
+	for _, result := range results {
+		if result.Error == "" {
+			succeeded++
+		}
+	}
+	slog.InfoContext(r.Context(), "Handled bulk request", "entries", len(entries), "succeeded", succeeded)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
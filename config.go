@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Config holds the settings used to build IcanhazlbService objects, set
+// from flags and optionally a YAML configuration file. String values in the
+// file, including list items and map values, may reference environment
+// variables as ${VAR}.
+type Config struct {
+	ListenAddr                string            `yaml:"listenAddr"`
+	TLSCertFile               string            `yaml:"tlsCertFile"`
+	TLSKeyFile                string            `yaml:"tlsKeyFile"`
+	DebugAddr                 string            `yaml:"debugAddr"`
+	ReadHeaderTimeout         time.Duration     `yaml:"readHeaderTimeout"`
+	ReadTimeout               time.Duration     `yaml:"readTimeout"`
+	WriteTimeout              time.Duration     `yaml:"writeTimeout"`
+	IdleTimeout               time.Duration     `yaml:"idleTimeout"`
+	MaxHeaderBytes            int               `yaml:"maxHeaderBytes"`
+	DisableKeepAlives         bool              `yaml:"disableKeepAlives"`
+	AccessLog                 bool              `yaml:"accessLog"`
+	MaxBodyBytes              int64             `yaml:"maxBodyBytes"`
+	BulkMaxEntries            int               `yaml:"bulkMaxEntries"`
+	GzipMinBytes              int               `yaml:"gzipMinBytes"`
+	AuthToken                 string            `yaml:"authToken"`
+	AuthTokenFile             string            `yaml:"authTokenFile"`
+	AllowedOrigins            []string          `yaml:"allowedOrigins"`
+	TrustForwardedHeaders     bool              `yaml:"trustForwardedHeaders"`
+	AllowCIDRs                []string          `yaml:"allowCidrs"`
+	AllowSpecialIPs           bool              `yaml:"allowSpecialIps"`
+	DenyCIDRs                 []string          `yaml:"denyCidrs"`
+	NamespaceRegex            string            `yaml:"namespaceRegex"`
+	CreateNamespace           bool              `yaml:"createNamespace"`
+	CreateIngress             bool              `yaml:"createIngress"`
+	ResolveFQDN               bool              `yaml:"resolveFqdn"`
+	ResolveFQDNTimeout        time.Duration     `yaml:"resolveFqdnTimeout"`
+	BaseDomain                string            `yaml:"baseDomain"`
+	MaxHostnameLength         int               `yaml:"maxHostnameLength"`
+	MaxHostnameLabels         int               `yaml:"maxHostnameLabels"`
+	Namespace                 string            `yaml:"namespace"`
+	NamePrefix                string            `yaml:"namePrefix"`
+	EndpointSliceNameTemplate string            `yaml:"endpointSliceNameTemplate"`
+	ServiceNameTemplate       string            `yaml:"serviceNameTemplate"`
+	IngressNameTemplate       string            `yaml:"ingressNameTemplate"`
+	IngressClassName          string            `yaml:"ingressClassName"`
+	CollapseSubdomains        bool              `yaml:"collapseSubdomains"`
+	IPLabelPosition           string            `yaml:"ipLabelPosition"`
+	IngressTLS                bool              `yaml:"ingressTLS"`
+	IngressClusterIssuer      string            `yaml:"ingressClusterIssuer"`
+	IngressTLSSecretSuffix    string            `yaml:"ingressTLSSecretSuffix"`
+	DefaultPath               string            `yaml:"defaultPath"`
+	DefaultPathType           string            `yaml:"defaultPathType"`
+	DefaultPort               int               `yaml:"defaultPort"`
+	DefaultPortName           string            `yaml:"defaultPortName"`
+	DefaultPorts              []IcanhazlbPort   `yaml:"defaultPorts"`
+	DefaultLabels             map[string]string `yaml:"defaultLabels"`
+	ObjectLabels              map[string]string `yaml:"objectLabels"`
+	ObjectAnnotations         map[string]string `yaml:"objectAnnotations"`
+	UpstreamVhost             string            `yaml:"upstreamVhost"`
+	SSLRedirect               bool              `yaml:"sslRedirect"`
+	ForceSSLRedirect          bool              `yaml:"forceSslRedirect"`
+	BackendProtocol           string            `yaml:"backendProtocol"`
+	IngressAnnotations        map[string]string `yaml:"ingressAnnotations"`
+	AllowedAnnotations        []string          `yaml:"allowedAnnotations"`
+	ServiceType               string            `yaml:"serviceType"`
+	Headless                  bool              `yaml:"headless"`
+	IPFamilyPolicy            string            `yaml:"ipFamilyPolicy"`
+	ExternalTrafficPolicy     string            `yaml:"externalTrafficPolicy"`
+	SessionAffinity           string            `yaml:"sessionAffinity"`
+	Async                     bool              `yaml:"async"`
+	AsyncWorkers              int               `yaml:"asyncWorkers"`
+	AsyncQueueSize            int               `yaml:"asyncQueueSize"`
+	MaxServices               int               `yaml:"maxServices"`
+	NotifyWebhookURL          string            `yaml:"notifyWebhookUrl"`
+	OwnerAPIVersion           string            `yaml:"ownerApiVersion"`
+	OwnerKind                 string            `yaml:"ownerKind"`
+	OwnerName                 string            `yaml:"ownerName"`
+	K8sTimeout                time.Duration     `yaml:"k8sTimeout"`
+	K8sQPS                    float64           `yaml:"k8sQps"`
+	K8sBurst                  int               `yaml:"k8sBurst"`
+	ConflictRetries           int               `yaml:"conflictRetries"`
+	RateLimit                 float64           `yaml:"rateLimit"`
+	RateBurst                 int               `yaml:"rateBurst"`
+
+	// annotationTemplates holds the compiled IngressAnnotations values,
+	// filled in by compileAnnotationTemplates
+	annotationTemplates map[string]*template.Template
+
+	// The compiled *NameTemplate settings, nil for the default names,
+	// filled in by compileNameTemplates
+	endpointSliceNameTemplate *template.Template
+	serviceNameTemplate       *template.Template
+	ingressNameTemplate       *template.Template
+
+	// namespaceRegex is the compiled NamespaceRegex, filled in by
+	// prepareConfig
+	namespaceRegex *regexp.Regexp
+
+	// The parsed AllowCIDRs and DenyCIDRs, filled in by prepareConfig
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	// owner is the resolved OwnerName, filled in at startup
+	owner *resolvedOwner
+
+	// metricsNamespace is the configured Namespace, kept for metric labels
+	// when a request picks another one
+	metricsNamespace string
+}
+
+var (
+	validServiceTypes            = []string{"ClusterIP", "NodePort", "LoadBalancer", "ExternalName"}
+	validPathTypes               = []string{"Exact", "Prefix", "ImplementationSpecific"}
+	validPortProtocols           = []string{"TCP", "UDP", "SCTP"}
+	validIPFamilyPolicies        = []string{"SingleStack", "PreferDualStack", "RequireDualStack"}
+	validExternalTrafficPolicies = []string{"Cluster", "Local"}
+	validSessionAffinities       = []string{"None", "ClientIP"}
+	validIPLabelPositions        = []string{ipLabelAnywhere, ipLabelLeftmost}
+	validBackendProtocols        = []string{"HTTP", "HTTPS", "GRPC"}
+)
+
+// configStore holds the active configuration, which a reload may replace
+// while requests are being handled
+type configStore struct {
+	mu     sync.RWMutex
+	config Config
+}
+
+func newConfigStore(config Config) *configStore {
+	return &configStore{config: config}
+}
+
+func (s *configStore) get() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+func (s *configStore) set(config Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// cloneConfig copies config, including its maps and slices, so that decoding
+// a config file over the copy leaves the original untouched
+func cloneConfig(config Config) Config {
+	config.AllowedOrigins = slices.Clone(config.AllowedOrigins)
+	config.AllowedAnnotations = slices.Clone(config.AllowedAnnotations)
+	config.AllowCIDRs = slices.Clone(config.AllowCIDRs)
+	config.DefaultPorts = slices.Clone(config.DefaultPorts)
+	config.DenyCIDRs = slices.Clone(config.DenyCIDRs)
+	config.DefaultLabels = maps.Clone(config.DefaultLabels)
+	config.ObjectLabels = maps.Clone(config.ObjectLabels)
+	config.ObjectAnnotations = maps.Clone(config.ObjectAnnotations)
+	config.IngressAnnotations = maps.Clone(config.IngressAnnotations)
+	return config
+}
+
+// loadConfigFile decodes the YAML file at path over config, leaving any
+// settings the file does not mention untouched
+func loadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	data, err = expandConfigEnv(data)
+	if err != nil {
+		return fmt.Errorf("failed to expand config file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("failed to parse config file: %v", err)
+	}
+	return nil
+}
+
+// envReference matches a ${VAR} environment variable reference. The bare
+// $VAR form isn't expanded, as Go templates and regexes use $ themselves.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandConfigEnv replaces the environment variable references in the
+// string values of a YAML document. Expanding the parsed values rather than
+// the raw text keeps a variable's value from changing the document's
+// structure. The document is returned unchanged if it has no references.
+func expandConfigEnv(data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	expanded, err := expandNodeEnv(&document)
+	if err != nil || !expanded {
+		return data, err
+	}
+	return yaml.Marshal(&document)
+}
+
+// expandNodeEnv expands the references in the string values under node,
+// reporting whether any were found. Unset variables are an error rather
+// than empty, as an empty authToken would silently disable authentication.
+func expandNodeEnv(node *yaml.Node) (bool, error) {
+	if node.Kind == yaml.ScalarNode {
+		if node.ShortTag() != "!!str" || !envReference.MatchString(node.Value) {
+			return false, nil
+		}
+
+		var missing []string
+		node.Value = envReference.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			value, found := os.LookupEnv(name)
+			if !found {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return false, fmt.Errorf("line %d references unset environment variables %s", node.Line, strings.Join(missing, ", "))
+		}
+		return true, nil
+	}
+
+	// Only mapping values are expanded, not their keys
+	start, step := 0, 1
+	if node.Kind == yaml.MappingNode {
+		start, step = 1, 2
+	}
+	expanded := false
+	for i := start; i < len(node.Content); i += step {
+		childExpanded, err := expandNodeEnv(node.Content[i])
+		if err != nil {
+			return false, err
+		}
+		expanded = expanded || childExpanded
+	}
+	return expanded, nil
+}
+
+func validateConfig(config Config) error {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("TLS certificate and key must be set together")
+	}
+	if config.AuthToken != "" && config.AuthTokenFile != "" {
+		return fmt.Errorf("auth token and auth token file are mutually exclusive")
+	}
+	if config.ReadHeaderTimeout <= 0 || config.ReadTimeout <= 0 || config.WriteTimeout <= 0 || config.IdleTimeout <= 0 {
+		return fmt.Errorf("server timeouts must be positive")
+	}
+	if config.MaxHeaderBytes < 1 {
+		return fmt.Errorf("invalid maximum header size %d: must be positive", config.MaxHeaderBytes)
+	}
+	if config.MaxBodyBytes < 0 {
+		return fmt.Errorf("invalid maximum body size %d: must not be negative", config.MaxBodyBytes)
+	}
+	if config.BulkMaxEntries < 0 {
+		return fmt.Errorf("invalid maximum bulk entries %d: must not be negative", config.BulkMaxEntries)
+	}
+	if config.GzipMinBytes < 0 {
+		return fmt.Errorf("invalid gzip minimum size %d: must not be negative", config.GzipMinBytes)
+	}
+	if _, err := parseCIDRs(config.AllowCIDRs); err != nil {
+		return fmt.Errorf("invalid allowed CIDRs: %v", err)
+	}
+	if _, err := parseCIDRs(config.DenyCIDRs); err != nil {
+		return fmt.Errorf("invalid denied CIDRs: %v", err)
+	}
+	if config.MaxHostnameLength < 1 || config.MaxHostnameLength > validation.DNS1123SubdomainMaxLength {
+		return fmt.Errorf("invalid maximum hostname length %d: must be between 1 and %d", config.MaxHostnameLength, validation.DNS1123SubdomainMaxLength)
+	}
+	if config.MaxHostnameLabels < 0 {
+		return fmt.Errorf("invalid maximum hostname labels %d: must not be negative", config.MaxHostnameLabels)
+	}
+	if config.BaseDomain != "" {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(strings.Trim(config.BaseDomain, "."))); len(errs) > 0 {
+			return fmt.Errorf("invalid base domain %q: %s", config.BaseDomain, strings.Join(errs, ", "))
+		}
+	}
+	if config.NamespaceRegex != "" {
+		re, err := regexp.Compile(config.NamespaceRegex)
+		if err != nil {
+			return fmt.Errorf("invalid namespace regex: %v", err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("invalid namespace regex %q: must have a capture group", config.NamespaceRegex)
+		}
+	}
+	if errs := validation.IsDNS1123Label(config.Namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", config.Namespace, strings.Join(errs, ", "))
+	}
+	// Check the longest name we can generate, from an IPv6 address, is valid
+	longestName := serviceName(config, strings.Repeat("f", len("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")))
+	if errs := validation.IsDNS1035Label(longestName); config.NamePrefix == "" || len(errs) > 0 {
+		return fmt.Errorf("invalid name prefix %q: generated names such as %q must be valid: %s", config.NamePrefix, longestName, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(config.IngressClassName); len(errs) > 0 {
+		return fmt.Errorf("invalid ingress class %q: %s", config.IngressClassName, strings.Join(errs, ", "))
+	}
+	if !strings.HasPrefix(config.DefaultPath, "/") {
+		return fmt.Errorf("invalid default path %q: must start with /", config.DefaultPath)
+	}
+	if !containsString(validPathTypes, config.DefaultPathType) {
+		return fmt.Errorf("invalid default path type %q: must be one of %s", config.DefaultPathType, strings.Join(validPathTypes, ", "))
+	}
+	if config.IngressTLS {
+		// Check the suffix forms a valid secret name after a host
+		if errs := validation.IsDNS1123Subdomain("host" + config.IngressTLSSecretSuffix); len(errs) > 0 {
+			return fmt.Errorf("invalid ingress TLS secret suffix %q: %s", config.IngressTLSSecretSuffix, strings.Join(errs, ", "))
+		}
+	}
+	if errs := validation.IsValidPortNum(config.DefaultPort); len(errs) > 0 {
+		return fmt.Errorf("invalid default port %d: %s", config.DefaultPort, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsValidPortName(config.DefaultPortName); len(errs) > 0 {
+		return fmt.Errorf("invalid default port name %q: %s", config.DefaultPortName, strings.Join(errs, ", "))
+	}
+	for _, port := range config.DefaultPorts {
+		if port.Protocol == "" {
+			port.Protocol = defaultPortProtocol
+		}
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("invalid default ports: %v", err)
+		}
+	}
+	if err := checkDuplicatePortNames(config.DefaultPorts); err != nil {
+		return fmt.Errorf("invalid default ports: %v", err)
+	}
+	if err := validateLabels(config.DefaultLabels); err != nil {
+		return fmt.Errorf("invalid default labels: %v", err)
+	}
+	if err := validateLabels(config.ObjectLabels); err != nil {
+		return fmt.Errorf("invalid object labels: %v", err)
+	}
+	for key := range config.ObjectAnnotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid object annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	for key := range config.IngressAnnotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid ingress annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	for _, key := range config.AllowedAnnotations {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid allowed annotation %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	if !containsString(validServiceTypes, config.ServiceType) {
+		return fmt.Errorf("invalid service type %q: must be one of %s", config.ServiceType, strings.Join(validServiceTypes, ", "))
+	}
+	if config.Headless && config.ServiceType != "ClusterIP" {
+		return fmt.Errorf("headless services must be of type ClusterIP, not %s", config.ServiceType)
+	}
+	if !containsString(validIPFamilyPolicies, config.IPFamilyPolicy) {
+		return fmt.Errorf("invalid IP family policy %q: must be one of %s", config.IPFamilyPolicy, strings.Join(validIPFamilyPolicies, ", "))
+	}
+	if config.ExternalTrafficPolicy != "" && !containsString(validExternalTrafficPolicies, config.ExternalTrafficPolicy) {
+		return fmt.Errorf("invalid external traffic policy %q: must be one of %s", config.ExternalTrafficPolicy, strings.Join(validExternalTrafficPolicies, ", "))
+	}
+	if config.BackendProtocol != "" && !containsString(validBackendProtocols, config.BackendProtocol) {
+		return fmt.Errorf("invalid backend protocol %q: must be one of %s", config.BackendProtocol, strings.Join(validBackendProtocols, ", "))
+	}
+	if !containsString(validIPLabelPositions, config.IPLabelPosition) {
+		return fmt.Errorf("invalid IP label position %q: must be one of %s", config.IPLabelPosition, strings.Join(validIPLabelPositions, ", "))
+	}
+	if config.SessionAffinity != "" && !containsString(validSessionAffinities, config.SessionAffinity) {
+		return fmt.Errorf("invalid session affinity %q: must be one of %s", config.SessionAffinity, strings.Join(validSessionAffinities, ", "))
+	}
+	if config.NotifyWebhookURL != "" {
+		webhookURL, err := url.Parse(config.NotifyWebhookURL)
+		if err != nil {
+			return fmt.Errorf("invalid notify webhook URL: %v", err)
+		}
+		if webhookURL.Scheme != "http" && webhookURL.Scheme != "https" {
+			return fmt.Errorf("invalid notify webhook URL %q: must be http or https", config.NotifyWebhookURL)
+		}
+	}
+	if config.OwnerName != "" && (config.OwnerAPIVersion == "" || config.OwnerKind == "") {
+		return fmt.Errorf("owner API version and kind must be set with the owner name")
+	}
+	if config.MaxServices < 0 {
+		return fmt.Errorf("invalid maximum services %d: must not be negative", config.MaxServices)
+	}
+	if config.AsyncWorkers < 1 {
+		return fmt.Errorf("invalid async worker count %d: must be at least 1", config.AsyncWorkers)
+	}
+	if config.AsyncQueueSize < 1 {
+		return fmt.Errorf("invalid async queue size %d: must be at least 1", config.AsyncQueueSize)
+	}
+	if config.K8sTimeout <= 0 {
+		return fmt.Errorf("invalid Kubernetes API timeout %s: must be positive", config.K8sTimeout)
+	}
+	if config.K8sQPS <= 0 {
+		return fmt.Errorf("invalid Kubernetes API QPS %v: must be positive", config.K8sQPS)
+	}
+	if config.K8sBurst < 1 {
+		return fmt.Errorf("invalid Kubernetes API burst %d: must be at least 1", config.K8sBurst)
+	}
+	if config.ResolveFQDN && config.ResolveFQDNTimeout <= 0 {
+		return fmt.Errorf("invalid FQDN resolution timeout %s: must be positive", config.ResolveFQDNTimeout)
+	}
+	if config.ConflictRetries < 0 {
+		return fmt.Errorf("invalid conflict retries %d: must not be negative", config.ConflictRetries)
+	}
+	if config.RateLimit < 0 {
+		return fmt.Errorf("invalid rate limit %v: must not be negative", config.RateLimit)
+	}
+	if config.RateLimit > 0 && config.RateBurst < 1 {
+		return fmt.Errorf("invalid rate burst %d: must be at least 1", config.RateBurst)
+	}
+	return nil
+}
+
+// validateLabels checks labels use valid Kubernetes label syntax
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid label value %q for %q: %s", value, key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// prepareConfig fills in the settings derived from a validated config, such
+// as the compiled annotation templates, namespace regex and CIDRs, and the
+// auth token read from its file
+func prepareConfig(config *Config) error {
+	if err := compileAnnotationTemplates(config); err != nil {
+		return err
+	}
+	if err := compileNameTemplates(config); err != nil {
+		return err
+	}
+
+	config.metricsNamespace = config.Namespace
+	config.namespaceRegex = nil
+	if config.NamespaceRegex != "" {
+		config.namespaceRegex = regexp.MustCompile(config.NamespaceRegex)
+	}
+
+	var err error
+	if config.allowNets, err = parseCIDRs(config.AllowCIDRs); err != nil {
+		return fmt.Errorf("invalid allowed CIDRs: %v", err)
+	}
+	if config.denyNets, err = parseCIDRs(config.DenyCIDRs); err != nil {
+		return fmt.Errorf("invalid denied CIDRs: %v", err)
+	}
+
+	if config.AuthTokenFile != "" {
+		data, err := os.ReadFile(config.AuthTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read auth token file: %v", err)
+		}
+		config.AuthToken = strings.TrimSpace(string(data))
+		if config.AuthToken == "" {
+			return fmt.Errorf("auth token file %s is empty", config.AuthTokenFile)
+		}
+	}
+	return nil
+}
+
+// compileAnnotationTemplates parses each ingress annotation value as a Go
+// template, so a bad template is caught at startup rather than per request
+func compileAnnotationTemplates(config *Config) error {
+	templates := make(map[string]*template.Template, len(config.IngressAnnotations))
+	for key, value := range config.IngressAnnotations {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid template for ingress annotation %q: %v", key, err)
+		}
+		templates[key] = tmpl
+	}
+	config.annotationTemplates = templates
+	return nil
+}
+
+// annotationTemplateData is the context ingress annotation templates are
+// rendered with
+type annotationTemplateData struct {
+	IP       string
+	Hostname string
+	Name     string
+}
+
+// renderAnnotations executes the compiled ingress annotation templates
+func renderAnnotations(config Config, data annotationTemplateData) (map[string]string, error) {
+	annotations := make(map[string]string, len(config.annotationTemplates))
+	for key, tmpl := range config.annotationTemplates {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, data); err != nil {
+			return nil, fmt.Errorf("failed to render ingress annotation %q: %v", key, err)
+		}
+		annotations[key] = value.String()
+	}
+	return annotations, nil
+}
+
+// compileNameTemplates parses the per-kind object name templates, leaving
+// unset ones nil so the default names are used
+func compileNameTemplates(config *Config) error {
+	for _, nameTemplate := range []struct {
+		kind  string
+		value string
+		tmpl  **template.Template
+	}{
+		{"endpointslice", config.EndpointSliceNameTemplate, &config.endpointSliceNameTemplate},
+		{"service", config.ServiceNameTemplate, &config.serviceNameTemplate},
+		{"ingress", config.IngressNameTemplate, &config.ingressNameTemplate},
+	} {
+		*nameTemplate.tmpl = nil
+		if nameTemplate.value == "" {
+			continue
+		}
+		tmpl, err := template.New(nameTemplate.kind).Option("missingkey=error").Parse(nameTemplate.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s name template: %v", nameTemplate.kind, err)
+		}
+		*nameTemplate.tmpl = tmpl
+	}
+	return nil
+}
+
+// objectNames are the names of the objects generated for a request
+type objectNames struct {
+	endpointSlice string
+	service       string
+	ingress       string
+}
+
+// renderObjectNames renders the configured name templates, falling back to
+// the default names, and checks the results are valid object names
+func renderObjectNames(config Config, data annotationTemplateData, svcFriendlyIp string) (objectNames, error) {
+	names := objectNames{
+		endpointSlice: serviceName(config, svcFriendlyIp),
+		service:       serviceName(config, svcFriendlyIp),
+		ingress:       ingressName(config, svcFriendlyIp),
+	}
+	for _, nameTemplate := range []struct {
+		tmpl *template.Template
+		name *string
+	}{
+		{config.endpointSliceNameTemplate, &names.endpointSlice},
+		{config.serviceNameTemplate, &names.service},
+		{config.ingressNameTemplate, &names.ingress},
+	} {
+		if nameTemplate.tmpl == nil {
+			continue
+		}
+		var name strings.Builder
+		if err := nameTemplate.tmpl.Execute(&name, data); err != nil {
+			return objectNames{}, fmt.Errorf("failed to render %s name: %v", nameTemplate.tmpl.Name(), err)
+		}
+		*nameTemplate.name = name.String()
+	}
+	// Services need the stricter DNS label form
+	if errs := validation.IsDNS1035Label(names.service); len(errs) > 0 {
+		return objectNames{}, fmt.Errorf("invalid service name %q: %s", names.service, strings.Join(errs, ", "))
+	}
+	for kind, name := range map[string]string{"endpointslice": names.endpointSlice, "ingress": names.ingress} {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return objectNames{}, fmt.Errorf("invalid %s name %q: %s", kind, name, strings.Join(errs, ", "))
+		}
+	}
+	return names, nil
+}
+
+// parseKeyValueList parses a comma-separated list of key=value pairs
+func parseKeyValueList(value string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range splitCommaList(value) {
+		key, val, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("%q must be in key=value form", pair)
+		}
+		values[key] = val
+	}
+	return values, nil
+}
+
+// splitCommaList splits a comma-separated flag value, dropping empty entries
+func splitCommaList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
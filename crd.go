@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+)
+
+// errCRDNotRegistered is returned when the API server doesn't serve
+// IcanhazlbServices, so every create would fail
+var errCRDNotRegistered = errors.New("resource " + icanhazlbServicePlural + "." + icanhazlbAPIGroup + " is not registered, is the IcanhazlbService CRD installed?")
+
+// checkCRDRegistered uses discovery to confirm the API server serves
+// IcanhazlbServices
+func checkCRDRegistered(ctx context.Context, discoveryClient discovery.DiscoveryInterface) error {
+	var resources v1.APIResourceList
+	err := discoveryClient.RESTClient().Get().
+		AbsPath("/apis", icanhazlbAPIGroup, icanhazlbAPIVersion).
+		Do(ctx).
+		Into(&resources)
+	if apierrors.IsNotFound(err) {
+		return errCRDNotRegistered
+	}
+	if err != nil {
+		return fmt.Errorf("failed to discover %s/%s resources: %v", icanhazlbAPIGroup, icanhazlbAPIVersion, err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == icanhazlbServicePlural {
+			return nil
+		}
+	}
+	return errCRDNotRegistered
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventComponent = "icanhazlb-api"
+
+// newEventRecorder returns a recorder that posts Kubernetes Events through
+// clientset, and a function that flushes and stops it
+func newEventRecorder(clientset kubernetes.Interface) (record.EventRecorder, func()) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	broadcaster.StartEventWatcher(func(event *corev1.Event) {
+		slog.Debug("Recorded event", "reason", event.Reason, "object", event.InvolvedObject.Name, "message", event.Message)
+	})
+
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	return recorder, broadcaster.Shutdown
+}
+
+// serviceReference refers to the IcanhazlbService named name, which may not
+// exist yet when recording a failure to create it
+func serviceReference(config Config, name string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: icanhazlbServiceGVR.GroupVersion().String(),
+		Kind:       "IcanhazlbService",
+		Namespace:  config.Namespace,
+		Name:       name,
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// runGarbageCollector periodically deletes IcanhazlbServices named with
+// prefix that are older than ttl, until ctx is cancelled. An empty namespace
+// collects them from every namespace.
+func runGarbageCollector(ctx context.Context, dynamicClient dynamic.Interface, namespace, prefix string, ttl, interval time.Duration) {
+	slog.Info("Starting garbage collector", "namespace", namespace, "prefix", prefix, "ttl", ttl, "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Garbage collector stopped")
+			return
+		case <-ticker.C:
+			if err := collectExpiredServices(ctx, dynamicClient, namespace, prefix, ttl); err != nil {
+				slog.Error("Garbage collection failed", "namespace", namespace, "error", err)
+			}
+		}
+	}
+}
+
+func collectExpiredServices(ctx context.Context, dynamicClient dynamic.Interface, namespace, prefix string, ttl time.Duration) error {
+	resource := dynamicClient.Resource(icanhazlbServiceGVR)
+
+	start := time.Now()
+	list, err := resource.Namespace(namespace).List(ctx, v1.ListOptions{})
+	k8sRequestDuration.WithLabelValues("list").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+
+	for _, item := range list.Items {
+		// Leave objects created by other instances alone
+		if !strings.HasPrefix(item.GetName(), prefix+"-") {
+			continue
+		}
+
+		age := time.Since(item.GetCreationTimestamp().Time)
+		if age < ttl {
+			continue
+		}
+
+		start := time.Now()
+		err := resource.Namespace(item.GetNamespace()).Delete(ctx, item.GetName(), v1.DeleteOptions{})
+		k8sRequestDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+		if err != nil {
+			slog.Error("Failed to delete expired CRD", "name", item.GetName(), "namespace", item.GetNamespace(), "age", age, "error", err)
+			continue
+		}
+		activeServices.Add(-1)
+		slog.Info("Deleted expired CRD", "name", item.GetName(), "namespace", item.GetNamespace(), "age", age, "outcome", "expired")
+	}
+
+	return nil
+}
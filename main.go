@@ -3,29 +3,102 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
 const (
-	icanhazlbAPIGroup      = "service.icanhazlb.com"
-	icanhazlbAPIVersion    = "v1alpha1"
-	icanhazlbServicePlural = "icanhazlbservices"
+	icanhazlbAPIGroup       = "service.icanhazlb.com"
+	icanhazlbAPIVersion     = "v1alpha1"
+	icanhazlbServicePlural  = "icanhazlbservices"
+	createdByAnnotation     = "icanhazlb.com/created-by"
+	ipAddressAnnotation     = "icanhazlb.com/ip-address"
+	svcFriendlyIPAnnotation = "icanhazlb.com/svc-friendly-ip"
+	hostnameAnnotation      = "icanhazlb.com/hostname"
+	maxCreatedByLength      = 64
+	managedByLabel          = "app.kubernetes.io/managed-by"
+	managedByValue          = "icanhazlb-api"
+
+	sslRedirectAnnotation      = "nginx.ingress.kubernetes.io/ssl-redirect"
+	forceSSLRedirectAnnotation = "nginx.ingress.kubernetes.io/force-ssl-redirect"
+	backendProtocolAnnotation  = "nginx.ingress.kubernetes.io/backend-protocol"
+	upstreamVhostAnnotation    = "nginx.ingress.kubernetes.io/upstream-vhost"
+
+	defaultListenAddr        = ":8080"
+	defaultNamespace         = "default"
+	defaultNamePrefix        = "icanhazlb"
+	defaultPort              = 80
+	defaultPortName          = "http"
+	defaultPortProtocol      = "TCP"
+	defaultServiceType       = "ClusterIP"
+	defaultIPFamilyPolicy    = "SingleStack"
+	ipLabelAnywhere          = "anywhere"
+	ipLabelLeftmost          = "leftmost"
+	defaultIngressClass      = "nginx"
+	defaultPath              = "/"
+	defaultPathType          = "ImplementationSpecific"
+	defaultTLSSecretSuffix   = "-tls"
+	defaultK8sTimeout        = 10 * time.Second
+	defaultConflictRetries   = 5
+	defaultResolveTimeout    = 5 * time.Second
+	readinessTimeout         = 2 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultMaxBodyBytes      = 1 << 20
+	defaultBulkMaxEntries    = 100
+	defaultGzipMinBytes      = 1024
+	defaultGCInterval        = time.Minute
+	defaultRateBurst         = 5
+	defaultAsyncWorkers      = 4
+	defaultAsyncQueueSize    = 100
+	listenAddrEnvVar         = "ICANHAZLB_LISTEN_ADDR"
+	allowedMethods           = "GET, POST, DELETE"
+	ipPathPrefix             = "/ip/"
+	servicesPathPrefix       = "/services/"
 )
 
+var icanhazlbServiceGVR = schema.GroupVersionResource{
+	Group:    icanhazlbAPIGroup,
+	Version:  icanhazlbAPIVersion,
+	Resource: icanhazlbServicePlural,
+}
+
 type IcanhazlbService struct {
 	v1.TypeMeta   `json:",inline"`
 	v1.ObjectMeta `json:"metadata,omitempty"`
@@ -35,7 +108,7 @@ type IcanhazlbService struct {
 type IcanhazlbServiceSpec struct {
 	EndpointSlices IcanhazlbEndpointSlices `json:"endpointSlices"`
 	Services       IcanhazlbServices       `json:"services"`
-	Ingresses      IcanhazlbIngresses      `json:"ingresses"`
+	Ingresses      *IcanhazlbIngresses     `json:"ingresses,omitempty"`
 }
 
 type IcanhazlbEndpointSlices struct {
@@ -47,20 +120,32 @@ type IcanhazlbEndpointSlices struct {
 }
 
 type IcanhazlbPort struct {
-	Name string `json:"name"`
-	Port int    `json:"port"`
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
 }
 
 type IcanhazlbEndpoint struct {
-	Addresses []string `json:"addresses"`
+	Addresses  []string                    `json:"addresses"`
+	Conditions IcanhazlbEndpointConditions `json:"conditions"`
+}
+
+type IcanhazlbEndpointConditions struct {
+	Ready       bool `json:"ready"`
+	Serving     bool `json:"serving"`
+	Terminating bool `json:"terminating"`
 }
 
 type IcanhazlbServices struct {
-	Name       string            `json:"name"`
-	Type       string            `json:"type"`
-	IPFamilies []string          `json:"ipFamilies"`
-	Ports      []IcanhazlbPort   `json:"ports"`
-	Labels     map[string]string `json:"labels"`
+	Name                  string            `json:"name"`
+	Type                  string            `json:"type"`
+	IPFamilies            []string          `json:"ipFamilies"`
+	IPFamilyPolicy        string            `json:"ipFamilyPolicy,omitempty"`
+	ExternalTrafficPolicy string            `json:"externalTrafficPolicy,omitempty"`
+	SessionAffinity       string            `json:"sessionAffinity,omitempty"`
+	ClusterIP             string            `json:"clusterIP,omitempty"`
+	Ports                 []IcanhazlbPort   `json:"ports"`
+	Labels                map[string]string `json:"labels"`
 }
 
 type IcanhazlbIngresses struct {
@@ -68,6 +153,12 @@ type IcanhazlbIngresses struct {
 	Annotations      map[string]string      `json:"annotations"`
 	IngressClassName string                 `json:"ingressClassName"`
 	Rules            []IcanhazlbIngressRule `json:"rules"`
+	TLS              []IcanhazlbIngressTLS  `json:"tls,omitempty"`
+}
+
+type IcanhazlbIngressTLS struct {
+	Hosts      []string `json:"hosts"`
+	SecretName string   `json:"secretName"`
 }
 
 type IcanhazlbIngressRule struct {
@@ -98,230 +189,2511 @@ type IcanhazlbBackendPort struct {
 	Number intstr.IntOrString `json:"number"`
 }
 
-var kubeconfig string
+var (
+	kubeconfig   string
+	configFile   string
+	logFormat    string
+	logLevel     string
+	ttl          time.Duration
+	gcInterval   time.Duration
+	preStopDelay time.Duration
+	config       Config
+)
 
 func main() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to the kubeconfig file")
+	flag.StringVar(&configFile, "config", "", "Path to a YAML configuration file, whose string values may reference environment variables as ${VAR}; flags override values set in the file")
+	flag.StringVar(&config.ListenAddr, "listen-addr", "", fmt.Sprintf("Address for the HTTP server to listen on (default %q, or $%s)", defaultListenAddr, listenAddrEnvVar))
+	flag.StringVar(&config.TLSCertFile, "tls-cert", "", "Path to a TLS certificate file; serves HTTPS when set with -tls-key")
+	flag.StringVar(&config.TLSKeyFile, "tls-key", "", "Path to a TLS private key file; serves HTTPS when set with -tls-cert")
+	flag.StringVar(&config.DebugAddr, "debug-addr", "", "Address to serve pprof profiling endpoints on, separately from -listen-addr (empty disables them)")
+	flag.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", defaultReadHeaderTimeout, "Maximum time to read request headers")
+	flag.DurationVar(&config.ReadTimeout, "read-timeout", defaultReadTimeout, "Maximum time to read a whole request, including the body")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", defaultWriteTimeout, "Maximum time to write a response")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", defaultIdleTimeout, "Maximum time to keep an idle keep-alive connection open")
+	flag.IntVar(&config.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes")
+	flag.BoolVar(&config.DisableKeepAlives, "disable-keepalives", false, "Close each client connection after one request instead of keeping it alive")
+	flag.Int64Var(&config.MaxBodyBytes, "max-body-bytes", defaultMaxBodyBytes, "Maximum size of a request body in bytes")
+	flag.IntVar(&config.BulkMaxEntries, "bulk-max-entries", defaultBulkMaxEntries, "Maximum number of entries in a /bulk request, refusing more with 413 (0 is unlimited)")
+	flag.IntVar(&config.GzipMinBytes, "gzip-min-bytes", defaultGzipMinBytes, "Gzip JSON responses of at least this many bytes for clients that accept it (0 disables compression)")
+	flag.StringVar(&config.AuthToken, "auth-token", "", "Bearer token required in the Authorization header of API requests (empty disables authentication)")
+	flag.StringVar(&config.AuthTokenFile, "auth-token-file", "", "Path to a file containing the bearer token, instead of -auth-token")
+	flag.Func("allowed-origins", "Comma-separated origins allowed to call the API from a browser, or * for any (default none)", func(value string) error {
+		config.AllowedOrigins = splitCommaList(value)
+		return nil
+	})
+	flag.BoolVar(&config.TrustForwardedHeaders, "trust-forwarded-headers", false, "Use the host from the Forwarded or X-Forwarded-Host header, when present, as the requested hostname, and the client from X-Forwarded-For for rate limiting and the created-by annotation")
+	flag.Func("allow-cidrs", "Comma-separated CIDRs backend IPs must fall within (default allows all)", func(value string) error {
+		config.AllowCIDRs = splitCommaList(value)
+		return nil
+	})
+	flag.BoolVar(&config.AllowSpecialIPs, "allow-special-ips", false, "Allow loopback, multicast, unspecified and link-local backend IPs")
+	flag.Func("deny-cidrs", "Comma-separated CIDRs backend IPs must not fall within", func(value string) error {
+		config.DenyCIDRs = splitCommaList(value)
+		return nil
+	})
+	flag.IntVar(&config.MaxHostnameLength, "max-hostname-length", validation.DNS1123SubdomainMaxLength, fmt.Sprintf("Maximum length of a requested hostname, refusing longer ones with 400 (at most %d)", validation.DNS1123SubdomainMaxLength))
+	flag.IntVar(&config.MaxHostnameLabels, "max-hostname-labels", 0, "Maximum number of DNS labels in a requested hostname, refusing more with 400 (0 is unlimited)")
+	flag.StringVar(&config.BaseDomain, "base-domain", "", "Only serve hostnames and aliases under this domain, refusing others with 403 (empty allows any)")
+	flag.StringVar(&config.Namespace, "namespace", defaultNamespace, "Namespace to create IcanhazlbService objects in")
+	flag.StringVar(&config.NamespaceRegex, "namespace-regex", "", "Regular expression whose first capture group picks the namespace from the hostname, falling back to -namespace when it doesn't match")
+	flag.BoolVar(&config.ResolveFQDN, "resolve-fqdn", false, "Resolve fqdn= backends to their IPv4 addresses when creating, instead of using an FQDN EndpointSlice. Required for fqdn= unless -allow-special-ips is set and no -allow-cidrs or -deny-cidrs are given, so the resolved IPs can be checked")
+	flag.DurationVar(&config.ResolveFQDNTimeout, "resolve-fqdn-timeout", defaultResolveTimeout, "Timeout for resolving fqdn= backends with -resolve-fqdn")
+	flag.BoolVar(&config.CreateIngress, "create-ingress", true, "Create an ingress for each service, unless a request passes ingress=false")
+	flag.BoolVar(&config.CreateNamespace, "create-namespace", false, "Create the namespace of an object if it doesn't exist")
+	flag.StringVar(&config.DefaultPath, "default-path", defaultPath, "Path of the generated ingress rule")
+	flag.StringVar(&config.DefaultPathType, "default-path-type", defaultPathType, fmt.Sprintf("Path type of the generated ingress rule (one of %s)", strings.Join(validPathTypes, ", ")))
+	flag.Func("default-ports", "Comma-separated name:number[:protocol] ports of every generated service, e.g. http:80,https:443 (replaces -default-port and -default-port-name)", func(value string) error {
+		var ports []IcanhazlbPort
+		for _, spec := range splitCommaList(value) {
+			port, err := parsePortSpec(spec, defaultPortProtocol)
+			if err != nil {
+				return err
+			}
+			ports = append(ports, port)
+		}
+		config.DefaultPorts = ports
+		return nil
+	})
+	flag.IntVar(&config.DefaultPort, "default-port", defaultPort, "Port exposed by the generated service and ingress backend")
+	flag.StringVar(&config.DefaultPortName, "default-port-name", defaultPortName, "Name of the port exposed by the generated service")
+	flag.StringVar(&config.NamePrefix, "name-prefix", defaultNamePrefix, "Prefix for the names of all generated objects")
+	flag.StringVar(&config.EndpointSliceNameTemplate, "endpointslice-name-template", "", "Go template for generated EndpointSlice names, with .IP, .Hostname and .Name (default <name-prefix>-<ip>-svc)")
+	flag.StringVar(&config.ServiceNameTemplate, "service-name-template", "", "Go template for generated service names, with .IP, .Hostname and .Name (default <name-prefix>-<ip>-svc)")
+	flag.StringVar(&config.IngressNameTemplate, "ingress-name-template", "", "Go template for generated ingress names, with .IP, .Hostname and .Name (default <name-prefix>-<ip>-ing)")
+	flag.StringVar(&config.IngressClassName, "ingress-class", defaultIngressClass, "Ingress class of the generated ingress")
+	flag.Func("default-labels", "Comma-separated key=value labels applied to every generated service and EndpointSlice", func(value string) error {
+		labels, err := parseKeyValueList(value)
+		config.DefaultLabels = labels
+		return err
+	})
+	config.ObjectLabels = map[string]string{managedByLabel: managedByValue}
+	flag.Func("object-labels", fmt.Sprintf("Comma-separated key=value labels applied to the metadata of every IcanhazlbService (default %s=%s)", managedByLabel, managedByValue), func(value string) error {
+		labels, err := parseKeyValueList(value)
+		config.ObjectLabels = labels
+		return err
+	})
+	flag.Func("object-annotations", "Comma-separated key=value annotations applied to the metadata of every IcanhazlbService", func(value string) error {
+		annotations, err := parseKeyValueList(value)
+		config.ObjectAnnotations = annotations
+		return err
+	})
+	flag.StringVar(&config.IPLabelPosition, "ip-label-position", ipLabelAnywhere, "Where in the hostname to look for the IP address: anywhere, or only the leftmost DNS label, e.g. 10-0-0-5 in 10-0-0-5.svc.example.com, which can't hold a dotted address")
+	flag.BoolVar(&config.CollapseSubdomains, "collapse-subdomains", false, "Route all subdomains of an IP hostname to one object with a wildcard ingress host, plus a rule for the bare IP host the wildcard doesn't match")
+	flag.BoolVar(&config.IngressTLS, "ingress-tls", false, "Add a TLS section for the request host to the generated ingress")
+	flag.StringVar(&config.IngressClusterIssuer, "ingress-cluster-issuer", "", "cert-manager cluster issuer annotation for the generated ingress when -ingress-tls is set")
+	flag.StringVar(&config.IngressTLSSecretSuffix, "ingress-tls-secret-suffix", defaultTLSSecretSuffix, "Suffix of the host-derived TLS secret name when -ingress-tls is set")
+	flag.BoolVar(&config.SSLRedirect, "ssl-redirect", false, "Set the nginx ssl-redirect ingress annotation to redirect HTTP to HTTPS when the ingress has TLS")
+	flag.BoolVar(&config.ForceSSLRedirect, "force-ssl-redirect", false, "Set the nginx force-ssl-redirect ingress annotation to redirect HTTP to HTTPS even without ingress TLS")
+	flag.StringVar(&config.BackendProtocol, "backend-protocol", "", fmt.Sprintf("Protocol the ingress controller uses to reach backends, set with the nginx backend-protocol annotation (one of %s, default unset for HTTP)", strings.Join(validBackendProtocols, ", ")))
+	flag.StringVar(&config.UpstreamVhost, "upstream-vhost", "", "Value for the nginx upstream-vhost ingress annotation (omitted when empty)")
+	flag.Func("allowed-annotations", "Comma-separated ingress annotation keys requests may add with annotation=. Requests can only add these keys, never replace an annotation the operator configured, even one with an allowed key (default none)", func(value string) error {
+		config.AllowedAnnotations = splitCommaList(value)
+		return nil
+	})
+	flag.StringVar(&config.IPFamilyPolicy, "ip-family-policy", defaultIPFamilyPolicy, fmt.Sprintf("IP family policy of the generated service (one of %s)", strings.Join(validIPFamilyPolicies, ", ")))
+	flag.StringVar(&config.ExternalTrafficPolicy, "external-traffic-policy", "", fmt.Sprintf("External traffic policy of NodePort and LoadBalancer services (one of %s, default unset)", strings.Join(validExternalTrafficPolicies, ", ")))
+	flag.StringVar(&config.SessionAffinity, "session-affinity", "", fmt.Sprintf("Session affinity of the generated service (one of %s, default unset)", strings.Join(validSessionAffinities, ", ")))
+	flag.StringVar(&config.ServiceType, "service-type", defaultServiceType, fmt.Sprintf("Type of the generated service (one of %s)", strings.Join(validServiceTypes, ", ")))
+	flag.BoolVar(&config.Headless, "headless", false, "Generate headless ClusterIP services, with clusterIP None, unless a request passes headless=false")
+	flag.BoolVar(&config.Async, "async", false, "Queue CRD creation in the background and return 202 Accepted straight away (per request with ?async=true)")
+	flag.IntVar(&config.AsyncWorkers, "async-workers", defaultAsyncWorkers, "Number of workers creating queued CRDs")
+	flag.IntVar(&config.AsyncQueueSize, "async-queue-size", defaultAsyncQueueSize, "Maximum number of queued CRD creations before requests are refused")
+	flag.StringVar(&config.OwnerAPIVersion, "owner-api-version", "apps/v1", "API version of the owner set with -owner-name")
+	flag.StringVar(&config.OwnerKind, "owner-kind", "Deployment", "Kind of the owner set with -owner-name")
+	flag.StringVar(&config.OwnerName, "owner-name", "", "Name of an object, in -namespace if namespaced, to set as the owner of every IcanhazlbService so they are garbage collected with it")
+	flag.IntVar(&config.MaxServices, "max-services", 0, "Maximum number of IcanhazlbServices to create in a namespace, or across all namespaces with -namespace-regex, refusing more with 507 (0 is unlimited)")
+	flag.StringVar(&config.NotifyWebhookURL, "notify-webhook-url", "", "URL to POST a JSON notification to whenever an IcanhazlbService is created")
+	flag.DurationVar(&config.K8sTimeout, "k8s-timeout", defaultK8sTimeout, "Timeout for Kubernetes API calls made while handling a request")
+	flag.Float64Var(&config.K8sQPS, "k8s-qps", float64(rest.DefaultQPS), "Queries per second allowed to the Kubernetes API before client-side throttling")
+	flag.IntVar(&config.K8sBurst, "k8s-burst", rest.DefaultBurst, "Burst of queries allowed to the Kubernetes API above -k8s-qps")
+	flag.IntVar(&config.ConflictRetries, "conflict-retries", defaultConflictRetries, "Times to retry updating an existing IcanhazlbService after a resourceVersion conflict")
+	flag.Float64Var(&config.RateLimit, "rate-limit", 0, "Requests per second allowed per client IP (0 disables rate limiting)")
+	flag.IntVar(&config.RateBurst, "rate-burst", defaultRateBurst, "Burst size allowed per client IP when rate limiting")
+	flag.DurationVar(&ttl, "ttl", 0, "Delete IcanhazlbServices older than this duration (0 disables garbage collection)")
+	flag.DurationVar(&gcInterval, "gc-interval", defaultGCInterval, "How often to check for expired IcanhazlbServices")
+	flag.DurationVar(&preStopDelay, "pre-stop-delay", 0, "How long to report not ready after a termination signal before shutting down, so load balancers can drain")
+	flag.StringVar(&logFormat, "log-format", "text", "Log output format (text or json)")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum log level (debug, info, warn or error)")
+	flag.BoolVar(&config.AccessLog, "access-log", false, "Log every request with its method, path, host, parsed IP, response status and latency")
 	flag.Parse()
 
+	// Set up structured logging before anything else is logged
+	logger, err := newLogger(logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	// Reloads start again from the defaults and flags
+	flagConfig := cloneConfig(config)
+
+	// Load the config file over the flag defaults, then parse the flags
+	// again so that any set explicitly take precedence over the file
+	if configFile != "" {
+		if err := loadConfigFile(configFile, &config); err != nil {
+			fatal("Failed to load configuration file", "path", configFile, "error", err)
+		}
+		flag.Parse()
+		slog.Info("Loaded configuration file", "path", configFile)
+	}
+
+	// Fall back to the environment, then the default listen address
+	if config.ListenAddr == "" {
+		config.ListenAddr = os.Getenv(listenAddrEnvVar)
+	}
+	if config.ListenAddr == "" {
+		config.ListenAddr = defaultListenAddr
+	}
+
+	// Validate the configuration before doing anything else
+	if err := validateConfig(config); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if err := prepareConfig(&config); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if preStopDelay < 0 {
+		fatal("Invalid pre-stop delay", "preStopDelay", preStopDelay)
+	}
+	if ttl < 0 || gcInterval <= 0 {
+		fatal("Invalid garbage collection settings", "ttl", ttl, "gcInterval", gcInterval)
+	}
+
 	// Build the Kubernetes configuration
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	restConfig, configSource, err := buildRestConfig(kubeconfig)
 	if err != nil {
-		log.Fatalf("Failed to build Kubernetes configuration: %v", err)
+		fatal("Failed to build Kubernetes configuration", "error", err)
 	}
+	restConfig.UserAgent = userAgent()
+	restConfig.QPS = float32(config.K8sQPS)
+	restConfig.Burst = config.K8sBurst
+	slog.Info("Built Kubernetes configuration", "source", configSource, "host", restConfig.Host, "userAgent", restConfig.UserAgent, "qps", restConfig.QPS, "burst", restConfig.Burst)
 
 	// Create the Kubernetes clientset
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		fatal("Failed to create Kubernetes clientset", "error", err)
+	}
+
+	// Create the dynamic client used for IcanhazlbService operations
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		fatal("Failed to create Kubernetes dynamic client", "error", err)
+	}
+
+	// Nothing works without the CRD, so refuse to start without it. Other
+	// discovery errors are left to /readyz, as the API server may just be
+	// briefly unavailable.
+	ctx, cancel := context.WithTimeout(context.Background(), config.K8sTimeout)
+	err = checkCRDRegistered(ctx, clientset.Discovery())
+	cancel()
+	if errors.Is(err, errCRDNotRegistered) {
+		fatal("IcanhazlbService CRD is missing", "error", err)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create Kubernetes clientset: %v", err)
+		slog.Warn("Failed to check for the IcanhazlbService CRD", "error", err)
+	}
+
+	// Start the active service count on /stats from what already exists
+	ctx, cancel = context.WithTimeout(context.Background(), config.K8sTimeout)
+	seedActiveServices(ctx, dynamicClient, config)
+	cancel()
+
+	// Look up the owner of the objects we create once, as references need
+	// its UID
+	if config.OwnerName != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), config.K8sTimeout)
+		config.owner, err = resolveOwner(ctx, clientset.Discovery(), dynamicClient, config)
+		cancel()
+		if err != nil {
+			fatal("Failed to resolve owner", "error", err)
+		}
+		slog.Info("Resolved owner", "kind", config.OwnerKind, "name", config.OwnerName, "uid", config.owner.reference.UID)
+	}
+
+	// Register the Prometheus metrics served on /metrics
+	registerMetrics()
+
+	// Cancelled on termination signal to stop background work
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Reload the configuration file on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// Handlers read the active configuration from here so reloads apply
+	// to the requests that follow
+	store := newConfigStore(config)
+
+	if ttl > 0 {
+		go runGarbageCollector(ctx, dynamicClient, listNamespace(config), config.NamePrefix, ttl, gcInterval)
 	}
 
+	// Records Kubernetes Events on the objects we create
+	recorder, stopRecorder := newEventRecorder(clientset)
+
+	// Set once terminating so /readyz takes us out of load balancers
+	var draining atomic.Bool
+
+	// Collapses concurrent identical create requests into one API call,
+	// whether they are handled synchronously or queued
+	var createGroup singleflight.Group
+
+	// Workers for requests that don't wait on the API server
+	creator := newAsyncCreator(dynamicClient, recorder, store, &createGroup, config.AsyncWorkers, config.AsyncQueueSize)
+
 	// Start the HTTP server
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: createHandler(clientset),
+		Addr:              config.ListenAddr,
+		Handler:           withMaxBodyBytes(createHandler(clientset, dynamicClient, recorder, store, &createGroup, creator, &draining), config.MaxBodyBytes),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
 	}
+	// Some proxies mishandle reused connections, so each request can be
+	// given its own
+	server.SetKeepAlivesEnabled(!config.DisableKeepAlives)
 
+	// Profiling is served on its own listener so it is never exposed on
+	// the public port
+	var debugServer *http.Server
+	if config.DebugAddr != "" {
+		debugServer = &http.Server{
+			Addr:              config.DebugAddr,
+			Handler:           newDebugHandler(),
+			ReadHeaderTimeout: config.ReadHeaderTimeout,
+		}
+		go func() {
+			slog.Info("Starting debug server", "debugAddr", debugServer.Addr)
+			if err := serve(debugServer, "", ""); err != nil {
+				fatal("Failed to start debug server", "error", err)
+			}
+		}()
+	}
+
+	tlsCertFile, tlsKeyFile := config.TLSCertFile, config.TLSKeyFile
 	go func() {
-		log.Println("Starting server on port 8080")
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Failed to start server: %v", err)
+		mode := "http"
+		if tlsCertFile != "" {
+			mode = "https"
+		}
+		slog.Info("Starting server", "listenAddr", server.Addr, "mode", mode)
+		if err := serve(server, tlsCertFile, tlsKeyFile); err != nil {
+			fatal("Failed to start server", "error", err)
 		}
 	}()
 
-	// Wait for termination signal
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	// Wait for termination signal, reloading the configuration on request
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-reload:
+			reloadConfig(store, flagConfig)
+		}
+	}
+
+	// Keep serving while load balancers notice we're no longer ready
+	if preStopDelay > 0 {
+		draining.Store(true)
+		slog.Info("Draining before shutdown", "preStopDelay", preStopDelay)
+		time.Sleep(preStopDelay)
+	}
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
 	// Gracefully shut down the server
 	err = server.Shutdown(context.Background())
 	if err != nil {
-		log.Printf("Error shutting down server: %v", err)
+		slog.Error("Error shutting down server", "error", err)
+	}
+	if debugServer != nil {
+		if err := debugServer.Shutdown(context.Background()); err != nil {
+			slog.Error("Error shutting down debug server", "error", err)
+		}
+	}
+
+	// No handlers are running any more, so finish off whatever they queued
+	slog.Info("Draining queued CRD requests", "queued", len(creator.queue))
+	creator.shutdown()
+
+	// Flush any events and webhook notifications still waiting to be sent
+	stopRecorder()
+	pendingNotifications.Wait()
+
+	slog.Info("Server stopped")
+}
+
+// serve runs server until it is shut down, over TLS when given a
+// certificate. It returns nil after a graceful shutdown and the error
+// otherwise, such as when the address is already in use.
+func serve(server *http.Server, tlsCertFile, tlsKeyFile string) error {
+	var err error
+	if tlsCertFile != "" {
+		err = server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	// ErrServerClosed is returned on graceful shutdown and isn't a failure
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// reloadConfig reapplies the configuration file and flags over flagConfig
+// and, if the result is valid, makes it the active configuration. Settings
+// used to start the server, workers, rate limiter and Kubernetes client, and
+// the owner, only change on restart.
+func reloadConfig(store *configStore, flagConfig Config) {
+	if configFile == "" {
+		slog.Warn("Ignoring reload request without a configuration file")
+		return
+	}
+
+	config = cloneConfig(flagConfig)
+	if err := loadConfigFile(configFile, &config); err != nil {
+		slog.Error("Failed to reload configuration file, keeping the current configuration", "path", configFile, "error", err)
+		return
+	}
+	flag.Parse()
+	config.ListenAddr = store.get().ListenAddr
+	config.owner = store.get().owner
+
+	if err := validateConfig(config); err != nil {
+		slog.Error("Invalid reloaded configuration, keeping the current configuration", "path", configFile, "error", err)
+		return
+	}
+	if err := prepareConfig(&config); err != nil {
+		slog.Error("Invalid reloaded configuration, keeping the current configuration", "path", configFile, "error", err)
+		return
+	}
+
+	store.set(config)
+	slog.Info("Reloaded configuration file", "path", configFile)
+}
+
+// buildRestConfig loads the Kubernetes client configuration from the given
+// kubeconfig file or, when empty, the in-cluster service account, falling
+// back to the default kubeconfig loading rules. It also reports which
+// source was used.
+func buildRestConfig(kubeconfig string) (*rest.Config, string, error) {
+	if kubeconfig != "" {
+		restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+		return restConfig, "kubeconfig " + kubeconfig, err
 	}
 
-	log.Println("Server stopped.")
+	restConfig, err := rest.InClusterConfig()
+	if err == nil {
+		return restConfig, "in-cluster", nil
+	}
+	slog.Debug("In-cluster configuration unavailable", "error", err)
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	restConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	return restConfig, "default kubeconfig", err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
-func createHandler(clientset *kubernetes.Clientset) http.Handler {
+// createHandler builds the API's routes. The clients are interfaces so the
+// fakes from k8s.io/client-go/kubernetes/fake and k8s.io/client-go/dynamic/fake
+// can stand in for a cluster.
+func createHandler(clientset kubernetes.Interface, dynamicClient dynamic.Interface, recorder record.EventRecorder, store *configStore, createGroup *singleflight.Group, creator *asyncCreator, draining *atomic.Bool) http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		hostname := extractHostnameFromRequest(r)
-		ipAddress := parseIPAddressFromHostname(hostname)
-		ingFriendlyHostname := strings.ReplaceAll(hostname, "_", "-")
-		svcFriendlyIp := strings.ReplaceAll(ipAddress, ".", "-")
 
-		err := createCRDInKubernetes(clientset, ipAddress, ingFriendlyHostname, svcFriendlyIp)
+	// Liveness probe, registered as an exact path so the catch-all below
+	// never creates a CRD for it
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	})
+
+	// Build metadata
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"version":   version,
+			"commit":    commit,
+			"buildDate": buildDate,
+		})
+	})
+
+	// Prometheus metrics
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/stats", serveStats)
+
+	// Readiness probe, which confirms the Kubernetes API server is reachable
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			writeJSONError(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		err := clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create CRD: %v", err), http.StatusInternalServerError)
+			writeJSONError(w, fmt.Sprintf("Kubernetes API server unreachable: %v", err), http.StatusServiceUnavailable)
 			return
 		}
 
-		response := map[string]string{
-			"ipAddress": ipAddress,
-			"hostname":  ingFriendlyHostname,
+		if err := checkCRDRegistered(ctx, clientset.Discovery()); err != nil {
+			writeJSONError(w, err.Error(), http.StatusServiceUnavailable)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
-	return mux
-}
+	mux.HandleFunc("/openapi.json", serveOpenAPISpec)
 
-func extractHostnameFromRequest(r *http.Request) string {
-	hostname := strings.SplitN(r.Host, ":", 2)[0]
-	return hostname
-}
+	// Lists the IcanhazlbServices in the namespace, or every tenant's with a
+	// namespace regex, optionally filtered by a name prefix
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSONError(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
 
-func parseIPAddressFromHostname(hostname string) string {
-	// Regular expression pattern for matching IP address formats
-	ipv4RE := `((\d{1,3}\.){3}\d{1,3}|(\d{1,3}-){3}\d{1,3}|(\d{1,3}_){3}\d{1,3}|(\d{1,3}[-_.]){3}\d{1,3})`
+		config := store.get()
+		config.Namespace = listNamespace(config)
+		ctx, cancel := context.WithTimeout(r.Context(), config.K8sTimeout)
+		defer cancel()
 
-	// Match the IP address using the regular expression
-	re := regexp.MustCompile(ipv4RE)
-	match := re.FindString(hostname)
+		icanhazlbServices, err := listCRDsInKubernetes(ctx, dynamicClient, config)
+		if err != nil && ctx.Err() != nil {
+			writeJSONError(w, fmt.Sprintf("Timed out listing CRDs: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to list CRDs", "error", err)
+			writeJSONError(w, fmt.Sprintf("Failed to list CRDs: %v", err), http.StatusInternalServerError)
+			return
+		}
 
-	if match != "" {
-		// Remove any non-numeric characters from the matched IP address
-		ip := strings.Map(func(r rune) rune {
-			if r == '-' || r == '_' || r == '.' {
-				return '.'
+		prefix := r.URL.Query().Get("prefix")
+		response := []map[string]string{}
+		for _, icanhazlbService := range icanhazlbServices {
+			if !strings.HasPrefix(icanhazlbService.Name, prefix) {
+				continue
 			}
-			return r
-		}, match)
 
-		// Validate and return the parsed IPv4 address
-		parsedIP := net.ParseIP(ip)
-		if parsedIP == nil || !parsedIP.To4().Equal(parsedIP) {
-			fmt.Printf("Failed to parse IPv4 address from hostname: %s\n", hostname)
-			return ""
+			ipAddress := ""
+			if endpoints := icanhazlbService.Spec.EndpointSlices.Endpoints; len(endpoints) > 0 && len(endpoints[0].Addresses) > 0 {
+				ipAddress = endpoints[0].Addresses[0]
+			}
+
+			response = append(response, map[string]string{
+				"name":              icanhazlbService.Name,
+				"namespace":         icanhazlbService.Namespace,
+				"ipAddress":         ipAddress,
+				"creationTimestamp": icanhazlbService.CreationTimestamp.UTC().Format(time.RFC3339),
+			})
 		}
-		return parsedIP.String()
-	}
 
-	fmt.Printf("Failed to parse IP address from hostname: %s\n", hostname)
-	return ""
-}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
 
-func createCRDInKubernetes(clientset *kubernetes.Clientset, ipAddress, hostname string, svcFriendlyIp string) error {
-	icanhazlbService := &IcanhazlbService{
-		TypeMeta: v1.TypeMeta{
-			APIVersion: fmt.Sprintf("%s/%s", icanhazlbAPIGroup, icanhazlbAPIVersion),
-			Kind:       "IcanhazlbService",
-		},
-		ObjectMeta: v1.ObjectMeta{
-			Name:      fmt.Sprintf("icanhazlb-%s", svcFriendlyIp),
-			Namespace: "default",
-		},
-		Spec: IcanhazlbServiceSpec{
-			EndpointSlices: IcanhazlbEndpointSlices{
-				Name:        fmt.Sprintf("icanhazlb-%s-svc", svcFriendlyIp),
-				AddressType: "IPv4",
-				Ports: []IcanhazlbPort{
-					{
-						Name: "http",
-						Port: 80,
-					},
-					// Add more ports if needed
-				},
-				Endpoints: []IcanhazlbEndpoint{
-					{
-						Addresses: []string{
-							ipAddress,
-						},
-					},
-				},
-				Labels: map[string]string{
-					"kubernetes.io/service-name": fmt.Sprintf("icanhazlb-%s-svc", svcFriendlyIp),
-				},
-			},
-			Services: IcanhazlbServices{
-				Name:       fmt.Sprintf("icanhazlb-%s-svc", svcFriendlyIp),
-				Type:       "ClusterIP",
-				IPFamilies: []string{"IPv4"},
-				Ports: []IcanhazlbPort{
-					{
-						Name: "http",
-						Port: 80,
-					},
-					// Add more ports if needed
-				},
-				Labels: map[string]string{
-					"kubernetes.io/service-name": fmt.Sprintf("icanhazlb-%s-svc", svcFriendlyIp),
-				},
-			},
-			Ingresses: IcanhazlbIngresses{
-				Name: fmt.Sprintf("icanhazlb-%s-ing", svcFriendlyIp),
-				Annotations: map[string]string{
-					"nginx.ingress.kubernetes.io/upstream-vhost": "retro.adrenlinerush.net",
-				},
-				IngressClassName: "nginx",
-				Rules: []IcanhazlbIngressRule{
-					{
-						Host: hostname,
-						HTTP: IcanhazlbHTTP{
-							Paths: []IcanhazlbHTTPPath{
-								{
-									Path:     "/",
-									PathType: "ImplementationSpecific",
-									Backend: IcanhazlbHTTPBackend{
-										Service: IcanhazlbHTTPServiceBackend{
-											Name: fmt.Sprintf("icanhazlb-%s-svc", svcFriendlyIp),
-											Port: IcanhazlbBackendPort{
-												Number: intstr.FromInt(80),
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
-	}
+	// Returns the spec of the IcanhazlbService for the IP in the path, e.g.
+	// /services/10.0.0.5 or /services/10-0-0-5
+	mux.HandleFunc(servicesPathPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSONError(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
 
-	raw, err := json.Marshal(icanhazlbService)
-	if err != nil {
-		return fmt.Errorf("failed to marshal CRD: %v", err)
-	}
+		// The path holds just the address rather than a hostname
+		ipAddress, err := parseIPAddressFromHostname(strings.TrimPrefix(r.URL.Path, servicesPathPrefix), ipLabelAnywhere)
+		if err != nil {
+			writeJSONError(w, fmt.Sprintf("Invalid IP address in path: %v", err), http.StatusBadRequest)
+			return
+		}
+		svcFriendlyIp := strings.NewReplacer(".", "-", ":", "-").Replace(ipAddress)
 
-	request := clientset.CoreV1().RESTClient().Post().
-		AbsPath(fmt.Sprintf("/apis/%s/%s/namespaces/default/%s", icanhazlbAPIGroup, icanhazlbAPIVersion, icanhazlbServicePlural)).
-		Body(raw)
+		config := store.get()
+		ctx, cancel := context.WithTimeout(r.Context(), config.K8sTimeout)
+		defer cancel()
 
-	response := request.Do(context.TODO())
-	if response.Error() != nil {
-		return fmt.Errorf("failed to create CRD: %v", response.Error())
-	}
+		// Tenants' objects may be in any namespace the regex picks
+		var icanhazlbService *IcanhazlbService
+		if config.namespaceRegex != nil {
+			icanhazlbService, err = findCRDInAllNamespaces(ctx, dynamicClient, config, svcFriendlyIp)
+		} else {
+			icanhazlbService, err = getCRDInKubernetes(ctx, dynamicClient, config, svcFriendlyIp)
+		}
+		if err != nil && ctx.Err() != nil {
+			writeJSONError(w, fmt.Sprintf("Timed out getting CRD: %v", err), http.StatusGatewayTimeout)
+			return
+		}
+		if apierrors.IsNotFound(err) {
+			writeJSONError(w, fmt.Sprintf("No IcanhazlbService for %s", ipAddress), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errAmbiguousNamespace) {
+			writeJSONError(w, fmt.Sprintf("%v, list them with /services", err), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to get CRD", "ip", ipAddress, "error", err)
+			writeJSONError(w, fmt.Sprintf("Failed to get CRD: %v", err), http.StatusInternalServerError)
+			return
+		}
 
-	rawResponse, err := response.Raw()
-	if err != nil {
-		return fmt.Errorf("failed to read raw response: %v", err)
-	}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":              icanhazlbService.Name,
+			"namespace":         icanhazlbService.Namespace,
+			"ipAddress":         ipAddress,
+			"creationTimestamp": icanhazlbService.CreationTimestamp.UTC().Format(time.RFC3339),
+			"spec":              icanhazlbService.Spec,
+		})
+	})
 
-	var decodedJSON struct {
-		Metadata struct {
-			ManagedFields []struct {
-				Operation *string `json:"operation"`
-			} `json:"managedFields"`
-		} `json:"metadata"`
+	// The rate limit is fixed at startup, as clients' limiters are kept
+	// across requests
+	var rateLimiter *clientRateLimiter
+	if config := store.get(); config.RateLimit > 0 {
+		rateLimiter = newClientRateLimiter(config.RateLimit, config.RateBurst)
 	}
 
-	if err := json.Unmarshal(rawResponse, &decodedJSON); err != nil {
-		return fmt.Errorf("failed to unmarshal JSON response: %v", err)
-	}
+	// Creates an IcanhazlbService for each entry of a JSON array, counting
+	// as a single request against the rate limit
+	bulk := &bulkCreator{clientset: clientset, dynamicClient: dynamicClient, recorder: recorder, group: createGroup}
+	mux.HandleFunc("/bulk", func(w http.ResponseWriter, r *http.Request) {
+		config := store.get()
+		if rateLimiter != nil {
+			if ok, retryAfter := rateLimiter.allow(requestingClient(r, config.TrustForwardedHeaders)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeJSONError(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		bulk.serveHTTP(w, r, config)
+	})
 
-	if len(decodedJSON.Metadata.ManagedFields) > 0 && decodedJSON.Metadata.ManagedFields[0].Operation != nil {
-		// The operation field is present, indicating success
-		fmt.Println("Success")
-	} else {
-		// The operation field is not present, indicating failure
-		fmt.Println("Failure")
-	}
+	// Creates, updates or deletes the IcanhazlbService for the requested host
+	crdHandler := func(w http.ResponseWriter, r *http.Request) {
+		config := store.get()
+		failures := crdFailuresTotal.MustCurryWith(crdMetricLabels(config))
 
-	return nil
+		// Only create on GET/POST so crawlers and probes using other
+		// methods can't accidentally create resources
+		switch r.Method {
+		case http.MethodGet, http.MethodPost, http.MethodDelete:
+		default:
+			w.Header().Set("Allow", allowedMethods)
+			writeJSONError(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Throttle each client so a single caller can't flood the API server.
+		// Behind a trusted proxy every request comes from the proxy, so the
+		// client is taken from X-Forwarded-For like for created-by.
+		if rateLimiter != nil {
+			if ok, retryAfter := rateLimiter.allow(requestingClient(r, config.TrustForwardedHeaders)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeJSONError(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		hostname := requestedHostname(r, config)
+
+		// Refuse oversized hosts before anything parses them
+		if err := checkHostnameLimits(config, hostname); err != nil {
+			failures.WithLabelValues("invalid_hostname").Inc()
+			slog.WarnContext(r.Context(), "Hostname too long", "method", r.Method, "outcome", "bad_request", "error", err)
+			writeFieldErrors(w, fieldErrors{{Field: "host", Message: err.Error()}})
+			return
+		}
+
+		ipAddress, parseErr := parseIPAddressFromHostname(hostname, config.IPLabelPosition)
+
+		// Backends only addressable by DNS name are given with fqdn= in place
+		// of an IP in the hostname
+		fqdnBackend := r.URL.Query().Get("fqdn")
+		if fqdnBackend != "" {
+			ipAddress, parseErr = parseFQDNBackend(config, fqdnBackend)
+		}
+		ingFriendlyHostname := strings.ReplaceAll(hostname, "_", "-")
+		var bareHost string
+		if config.CollapseSubdomains {
+			ingFriendlyHostname, bareHost = collapseSubdomains(ingFriendlyHostname)
+		}
+		svcFriendlyIp := strings.NewReplacer(".", "-", ":", "-").Replace(ipAddress)
+		if fqdnBackend != "" {
+			svcFriendlyIp = fqdnFriendlyName(ipAddress)
+		}
+		name := objectName(config, svcFriendlyIp)
+
+		logger := slog.With(
+			"method", r.Method,
+			"hostname", hostname,
+			"ip", ipAddress,
+			"name", name,
+		)
+
+		requestsTotal.WithLabelValues(r.Method).Inc()
+
+		// Only serve hosts under the managed domain so arbitrary Host headers
+		// can't be pointed at backends
+		if config.BaseDomain != "" && !hostnameInDomain(hostname, config.BaseDomain) {
+			failures.WithLabelValues("forbidden_host").Inc()
+			logger.WarnContext(r.Context(), "Hostname outside base domain", "outcome", "forbidden", "baseDomain", config.BaseDomain)
+			writeJSONError(w, fmt.Sprintf("Hostname %q is not under %s", hostname, config.BaseDomain), http.StatusForbidden)
+			return
+		}
+
+		// Collect every invalid parameter rather than stopping at the first,
+		// so callers can fix them all in one round trip
+		var invalid fieldErrors
+
+		// Refuse to build a CRD without a backend address, or with one the
+		// API server won't accept in a name
+		field := "host"
+		if fqdnBackend != "" {
+			field = "fqdn"
+		}
+		if parseErr != nil {
+			failures.WithLabelValues("invalid_hostname").Inc()
+			invalid.add(field, parseErr)
+		} else if err := validateObjectName(name); err != nil {
+			failures.WithLabelValues("invalid_hostname").Inc()
+			invalid.add(field, err)
+		}
+
+		// Each tenant's objects go in the namespace named in their hostname,
+		// falling back to the configured one when it doesn't match
+		if config.namespaceRegex != nil {
+			namespace, err := namespaceFromHostname(config.namespaceRegex, hostname)
+			if err != nil {
+				failures.WithLabelValues("invalid_namespace").Inc()
+				invalid.add("host", err)
+			}
+			if namespace != "" {
+				config.Namespace = namespace
+				logger = logger.With("namespace", namespace)
+			}
+		}
+
+		// Bound the Kubernetes API calls by the client's request and our timeout
+		ctx, cancel := context.WithTimeout(r.Context(), config.K8sTimeout)
+		defer cancel()
+
+		switch r.Method {
+		case http.MethodDelete:
+			if len(invalid) > 0 {
+				logger.WarnContext(r.Context(), "Invalid request parameters", "outcome", "bad_request", "error", invalid)
+				writeFieldErrors(w, invalid)
+				return
+			}
+
+			err := deleteCRDInKubernetes(ctx, dynamicClient, config, svcFriendlyIp)
+			if err != nil && ctx.Err() != nil {
+				failures.WithLabelValues("timeout").Inc()
+				logger.ErrorContext(r.Context(), "Timed out deleting CRD", "outcome", "timeout", "error", err)
+				writeJSONError(w, fmt.Sprintf("Timed out deleting CRD: %v", err), http.StatusGatewayTimeout)
+				return
+			}
+			if apierrors.IsNotFound(err) {
+				logger.InfoContext(r.Context(), "CRD not found", "outcome", "not_found")
+				writeJSONError(w, fmt.Sprintf("CRD not found: %v", err), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				failures.WithLabelValues("api_error").Inc()
+				logger.ErrorContext(r.Context(), "Failed to delete CRD", "outcome", "api_error", "error", err)
+				writeJSONError(w, fmt.Sprintf("Failed to delete CRD: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			response := map[string]string{
+				"ipAddress": ipAddress,
+				"hostname":  ingFriendlyHostname,
+				"status":    "deleted",
+				"name":      name,
+				"namespace": config.Namespace,
+			}
+			activeServices.Add(-1)
+			logger.InfoContext(r.Context(), "Deleted CRD", "outcome", "deleted")
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+		case http.MethodGet, http.MethodPost:
+			// A port encoded after the IP in the hostname overrides the
+			// number of the first default port
+			defaultPorts := configuredDefaultPorts(config)
+			if hostPort := parsePortFromHostname(r.Context(), hostnameForIP(hostname, config.IPLabelPosition)); hostPort != 0 {
+				defaultPorts[0].Port = hostPort
+			}
+
+			// Parameters that depend on the ports are only checked once the
+			// ports are valid
+			ports, err := parsePortsFromQuery(r.URL.Query(), defaultPorts)
+			if err != nil {
+				invalid.add("port", err)
+			}
+
+			var targetPorts []IcanhazlbPort
+			if ports != nil {
+				targetPorts, err = parseTargetPortsFromQuery(r.URL.Query(), ports)
+				if err != nil {
+					invalid.add("targetPort", err)
+				}
+			}
+
+			annotations, err := parseKeyValuesFromQuery(r.URL.Query(), "annotation")
+			if err == nil {
+				err = checkAnnotationsAllowed(annotations, config.AllowedAnnotations)
+			}
+			if err != nil {
+				invalid.add("annotation", err)
+			}
+
+			labels, err := parseKeyValuesFromQuery(r.URL.Query(), "label")
+			if err == nil {
+				err = validateLabels(labels)
+			}
+			if err != nil {
+				invalid.add("label", err)
+			}
+
+			// An FQDN backend is a single name with no IP to check, unless
+			// it is resolved to its current addresses
+			addresses := []string{ipAddress}
+			switch {
+			case parseErr != nil:
+				addresses = nil
+			case fqdnBackend == "":
+				addresses, err = parseAddressesFromQuery(r.URL.Query(), ipAddress)
+				if err != nil {
+					invalid.add("ips", err)
+				}
+			case config.ResolveFQDN:
+				addresses, err = resolveFQDN(r.Context(), ipAddress, config.ResolveFQDNTimeout)
+				if err != nil {
+					failures.WithLabelValues("unresolvable_fqdn").Inc()
+					invalid.add("fqdn", err)
+				}
+			}
+
+			// Refuse to point services at special addresses
+			backendIPs := fqdnBackend == "" || config.ResolveFQDN
+			if backendIPs && !config.AllowSpecialIPs {
+				for _, address := range addresses {
+					if err := checkSpecialIP(net.ParseIP(address)); err != nil {
+						failures.WithLabelValues("special_ip").Inc()
+						invalid.add("ips", fmt.Errorf("invalid backend IP: %v", err))
+					}
+				}
+			}
+
+			aliases, err := parseAliasesFromQuery(r.URL.Query(), ingFriendlyHostname)
+			if err != nil {
+				invalid.add("aliases", err)
+			}
+			aliases = withBareHost(aliases, bareHost)
+
+			var pathPorts []pathPort
+			if ports != nil {
+				pathPorts, err = parsePathPortsFromQuery(r.URL.Query(), ports)
+				if err != nil {
+					invalid.add("path", err)
+				}
+			}
+
+			conditions, err := parseConditionsFromQuery(r.URL.Query())
+			if err != nil {
+				invalid.add("conditions", err)
+			}
+
+			dryRun := parseBoolParam(r.URL.Query(), "dryRun", false, &invalid)
+			async := parseBoolParam(r.URL.Query(), "async", config.Async, &invalid)
+			createIngress := parseBoolParam(r.URL.Query(), "ingress", config.CreateIngress, &invalid)
+			headless := parseBoolParam(r.URL.Query(), "headless", config.Headless, &invalid)
+
+			clusterIP, err := parseClusterIP(r.URL.Query().Get("clusterIP"), headless, config.ServiceType)
+			if err != nil {
+				invalid.add("clusterIP", err)
+			}
+
+			if len(invalid) > 0 {
+				logger.WarnContext(r.Context(), "Invalid request parameters", "outcome", "bad_request", "error", invalid)
+				writeFieldErrors(w, invalid)
+				return
+			}
+
+			// Aliases become ingress rules too, so hold them to the same
+			// managed domain as the request host
+			if config.BaseDomain != "" {
+				for _, alias := range aliases {
+					if !hostnameInDomain(alias, config.BaseDomain) {
+						failures.WithLabelValues("forbidden_host").Inc()
+						logger.WarnContext(r.Context(), "Alias outside base domain", "outcome", "forbidden", "alias", alias, "baseDomain", config.BaseDomain)
+						writeJSONError(w, fmt.Sprintf("Alias %q is not under %s", alias, config.BaseDomain), http.StatusForbidden)
+						return
+					}
+				}
+			}
+
+			// An unresolved FQDN backend can point anywhere once the ingress
+			// controller resolves it, so it can't be held to the backend IP
+			// restrictions. Those need it resolved here instead.
+			backendIPsRestricted := len(config.allowNets) > 0 || len(config.denyNets) > 0 || !config.AllowSpecialIPs
+			if !backendIPs && backendIPsRestricted {
+				failures.WithLabelValues("forbidden_ip").Inc()
+				logger.WarnContext(r.Context(), "Unresolved FQDN backend with restricted backend IPs", "outcome", "forbidden", "fqdn", ipAddress)
+				writeJSONError(w, "FQDN backends must be resolved with -resolve-fqdn while backend IPs are restricted by -allow-cidrs, -deny-cidrs or special IP blocking", http.StatusForbidden)
+				return
+			}
+
+			// Refuse to point services outside the allowed ranges
+			if backendIPs {
+				for _, address := range addresses {
+					if err := checkIPAllowed(net.ParseIP(address), config.allowNets, config.denyNets); err != nil {
+						failures.WithLabelValues("forbidden_ip").Inc()
+						logger.WarnContext(r.Context(), "Backend IP not allowed", "outcome", "forbidden", "address", address, "error", err)
+						writeJSONError(w, fmt.Sprintf("Backend IP not allowed: %v", err), http.StatusForbidden)
+						return
+					}
+				}
+			}
+
+			req := crdRequest{
+				IPAddress:     ipAddress,
+				Hostname:      ingFriendlyHostname,
+				SvcFriendlyIp: svcFriendlyIp,
+				Ports:         ports,
+				TargetPorts:   targetPorts,
+				Annotations:   annotations,
+				Labels:        labels,
+				Addresses:     addresses,
+				CreatedBy:     requestingClient(r, config.TrustForwardedHeaders),
+				DryRun:        dryRun,
+				Aliases:       aliases,
+				FQDN:          fqdnBackend != "" && !config.ResolveFQDN,
+				Conditions:    conditions,
+				PathPorts:     pathPorts,
+				NoIngress:     !createIngress,
+				ClusterIP:     clusterIP,
+			}
+
+			// Refuse new objects once the maximum exist
+			if config.MaxServices > 0 && !dryRun {
+				count, err := checkServiceLimit(ctx, dynamicClient, config, name)
+				if errors.Is(err, errServiceLimitReached) {
+					failures.WithLabelValues("limit_reached").Inc()
+					logger.WarnContext(r.Context(), "Service limit reached", "outcome", "limit_reached", "count", count, "limit", config.MaxServices)
+					writeJSONErrorDetails(w, fmt.Sprintf("Maximum of %d services reached", config.MaxServices), http.StatusInsufficientStorage, map[string]interface{}{
+						"count": count,
+						"limit": config.MaxServices,
+					})
+					return
+				}
+				if err != nil && ctx.Err() != nil {
+					failures.WithLabelValues("timeout").Inc()
+					logger.ErrorContext(r.Context(), "Timed out counting CRDs", "outcome", "timeout", "error", err)
+					writeJSONError(w, fmt.Sprintf("Timed out counting CRDs: %v", err), http.StatusGatewayTimeout)
+					return
+				}
+				if err != nil {
+					failures.WithLabelValues("api_error").Inc()
+					logger.ErrorContext(r.Context(), "Failed to count CRDs", "outcome", "api_error", "error", err)
+					writeJSONError(w, fmt.Sprintf("Failed to count CRDs: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if config.CreateNamespace && !dryRun {
+				err := ensureNamespace(ctx, clientset, config.Namespace)
+				if err != nil && ctx.Err() != nil {
+					failures.WithLabelValues("timeout").Inc()
+					logger.ErrorContext(r.Context(), "Timed out creating namespace", "outcome", "timeout", "error", err)
+					writeJSONError(w, fmt.Sprintf("Timed out creating namespace: %v", err), http.StatusGatewayTimeout)
+					return
+				}
+				if err != nil {
+					failures.WithLabelValues("api_error").Inc()
+					logger.ErrorContext(r.Context(), "Failed to create namespace", "outcome", "api_error", "error", err)
+					writeJSONError(w, fmt.Sprintf("Failed to create namespace: %v", err), http.StatusInternalServerError)
+					return
+				}
+			}
+
+			// Dry runs return the would-be object, so they always wait
+			if async && !dryRun {
+				if !creator.enqueue(createJob{req: req, namespace: config.Namespace, requestID: requestIDFromContext(r.Context())}) {
+					failures.WithLabelValues("queue_full").Inc()
+					logger.WarnContext(r.Context(), "CRD request queue is full", "outcome", "queue_full")
+					writeJSONError(w, "Too many queued requests, try again later", http.StatusServiceUnavailable)
+					return
+				}
+
+				response := map[string]string{
+					"ipAddress": ipAddress,
+					"hostname":  ingFriendlyHostname,
+					"status":    "accepted",
+					"name":      name,
+					"namespace": config.Namespace,
+				}
+				logger.InfoContext(r.Context(), "Queued CRD request", "outcome", "accepted")
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+
+			icanhazlbService, created, err := createCRDOnce(ctx, createGroup, dynamicClient, recorder, config, req)
+			if err != nil && ctx.Err() != nil {
+				failures.WithLabelValues("timeout").Inc()
+				logger.ErrorContext(r.Context(), "Timed out creating CRD", "outcome", "timeout", "error", err)
+				writeJSONError(w, fmt.Sprintf("Timed out creating CRD: %v", err), http.StatusGatewayTimeout)
+				return
+			}
+			if err != nil {
+				failures.WithLabelValues("api_error").Inc()
+				logger.ErrorContext(r.Context(), "Failed to create CRD", "outcome", "api_error", "error", err)
+				writeJSONError(w, fmt.Sprintf("Failed to create CRD: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			// Return the would-be object without having touched the cluster
+			if dryRun {
+				logger.InfoContext(r.Context(), "Handled CRD request", "outcome", "dry_run")
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(icanhazlbService)
+				return
+			}
+
+			status := "updated"
+			if created {
+				status = "created"
+			}
+
+			response := map[string]string{
+				"ipAddress":         ipAddress,
+				"hostname":          ingFriendlyHostname,
+				"status":            status,
+				"name":              name,
+				"namespace":         config.Namespace,
+				"uid":               string(icanhazlbService.UID),
+				"resourceVersion":   icanhazlbService.ResourceVersion,
+				"creationTimestamp": icanhazlbService.CreationTimestamp.UTC().Format(time.RFC3339),
+			}
+			logger.InfoContext(r.Context(), "Handled CRD request", "outcome", status)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+		}
+	}
+
+	// Hosts are taken from the Host header, or from the path for clients
+	// that can't set it
+	mux.HandleFunc("/", crdHandler)
+	mux.HandleFunc(ipPathPrefix, crdHandler)
+
+	return withRequestCount(withRequestID(withAccessLog(withGzip(withCORS(withBearerAuth(mux, store), store), store), store)))
+}
+
+// parsePortsFromQuery builds the service ports from repeated
+// port=name:number[:protocol] query parameters, falling back to the given
+// default ports. An optional protocol= parameter sets the protocol of the
+// default ports and of port= values without one.
+func parsePortsFromQuery(query url.Values, defaultPorts []IcanhazlbPort) ([]IcanhazlbPort, error) {
+	defaultProtocol := ""
+	if protocol := query.Get("protocol"); protocol != "" {
+		defaultProtocol = strings.ToUpper(protocol)
+		if !containsString(validPortProtocols, defaultProtocol) {
+			return nil, fmt.Errorf("invalid protocol %q: must be one of %s", protocol, strings.Join(validPortProtocols, ", "))
+		}
+	}
+
+	values := query["port"]
+	if len(values) == 0 {
+		ports := make([]IcanhazlbPort, 0, len(defaultPorts))
+		for _, port := range defaultPorts {
+			if defaultProtocol != "" {
+				port.Protocol = defaultProtocol
+			}
+			ports = append(ports, port)
+		}
+		return ports, nil
+	}
+
+	if defaultProtocol == "" {
+		defaultProtocol = defaultPortProtocol
+	}
+	ports := make([]IcanhazlbPort, 0, len(values))
+	for _, value := range values {
+		port, err := parsePortSpec(value, defaultProtocol)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+
+	if err := checkDuplicatePortNames(ports); err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+// parsePortSpec parses a port in name:number[:protocol] form, using
+// defaultProtocol when it has none
+func parsePortSpec(value, defaultProtocol string) (IcanhazlbPort, error) {
+	name, number, found := strings.Cut(value, ":")
+	if !found {
+		return IcanhazlbPort{}, fmt.Errorf("port %q must be in name:number[:protocol] form", value)
+	}
+	number, protocol, found := strings.Cut(number, ":")
+	if !found {
+		protocol = defaultProtocol
+	}
+
+	port, err := strconv.Atoi(number)
+	if err != nil {
+		return IcanhazlbPort{}, fmt.Errorf("invalid port number %q: %v", number, err)
+	}
+
+	result := IcanhazlbPort{Name: name, Port: port, Protocol: strings.ToUpper(protocol)}
+	if err := validatePort(result); err != nil {
+		return IcanhazlbPort{}, err
+	}
+	return result, nil
+}
+
+// validatePort checks a port's name, number and protocol
+func validatePort(port IcanhazlbPort) error {
+	if !containsString(validPortProtocols, port.Protocol) {
+		return fmt.Errorf("invalid protocol %q for port %q: must be one of %s", port.Protocol, port.Name, strings.Join(validPortProtocols, ", "))
+	}
+	if errs := validation.IsValidPortName(port.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid port name %q: %s", port.Name, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsValidPortNum(port.Port); len(errs) > 0 {
+		return fmt.Errorf("invalid port number %d: %s", port.Port, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func checkDuplicatePortNames(ports []IcanhazlbPort) error {
+	seen := map[string]bool{}
+	for _, port := range ports {
+		if seen[port.Name] {
+			return fmt.Errorf("duplicate port name %q", port.Name)
+		}
+		seen[port.Name] = true
+	}
+	return nil
+}
+
+// configuredDefaultPorts returns a copy of the default ports list or, when
+// none is configured, the single default port
+func configuredDefaultPorts(config Config) []IcanhazlbPort {
+	if len(config.DefaultPorts) > 0 {
+		ports := slices.Clone(config.DefaultPorts)
+		for i := range ports {
+			if ports[i].Protocol == "" {
+				ports[i].Protocol = defaultPortProtocol
+			}
+		}
+		return ports
+	}
+	return []IcanhazlbPort{{Name: config.DefaultPortName, Port: config.DefaultPort, Protocol: defaultPortProtocol}}
+}
+
+// parseAddressesFromQuery returns the endpoint addresses for a request: the
+// IP parsed from the hostname plus any extra comma-separated ips= values,
+// which must share its address family
+func parseAddressesFromQuery(query url.Values, ipAddress string) ([]string, error) {
+	ipFamily := ipFamilyForAddress(ipAddress)
+	addresses := []string{ipAddress}
+	seen := map[string]bool{ipAddress: true}
+
+	for _, value := range query["ips"] {
+		for _, ip := range strings.Split(value, ",") {
+			ip = strings.TrimSpace(ip)
+			if ip == "" {
+				continue
+			}
+
+			parsedIP := net.ParseIP(ip)
+			if parsedIP == nil {
+				return nil, fmt.Errorf("invalid IP address %q", ip)
+			}
+			if ipFamilyForAddress(parsedIP.String()) != ipFamily {
+				return nil, fmt.Errorf("IP address %q is not %s like %s", ip, ipFamily, ipAddress)
+			}
+			if seen[parsedIP.String()] {
+				continue
+			}
+
+			seen[parsedIP.String()] = true
+			addresses = append(addresses, parsedIP.String())
+		}
+	}
+
+	return addresses, nil
+}
+
+// parseTargetPortsFromQuery builds the EndpointSlice ports, which are the
+// service ports with the numbers replaced by any targetPort=[name:]number
+// query parameters for backends listening on a different port. The name can
+// be left out when there is a single port.
+func parseTargetPortsFromQuery(query url.Values, ports []IcanhazlbPort) ([]IcanhazlbPort, error) {
+	targetPorts := slices.Clone(ports)
+	for _, value := range query["targetPort"] {
+		name, number, found := strings.Cut(value, ":")
+		if !found {
+			if len(ports) != 1 {
+				return nil, fmt.Errorf("target port %q must be in name:number form when there are several ports", value)
+			}
+			name, number = ports[0].Name, value
+		}
+
+		index := slices.IndexFunc(targetPorts, func(port IcanhazlbPort) bool { return port.Name == name })
+		if index < 0 {
+			return nil, fmt.Errorf("target port %q is not for one of the service ports", value)
+		}
+		port, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target port number %q: %v", number, err)
+		}
+		targetPorts[index].Port = port
+		if err := validatePort(targetPorts[index]); err != nil {
+			return nil, err
+		}
+	}
+	return targetPorts, nil
+}
+
+// parsePathPortsFromQuery builds ingress path to port mappings from
+// repeated path=/path:port query parameters, such as path=/api:8080. Each
+// port must be one of the service's ports.
+func parsePathPortsFromQuery(query url.Values, ports []IcanhazlbPort) ([]pathPort, error) {
+	var pathPorts []pathPort
+	seen := map[string]bool{}
+
+	for _, value := range query["path"] {
+		separator := strings.LastIndex(value, ":")
+		if separator < 0 {
+			return nil, fmt.Errorf("path %q must be in /path:port form", value)
+		}
+		path, portValue := value[:separator], value[separator+1:]
+
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q must start with /", path)
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("duplicate path %q", path)
+		}
+
+		port, err := strconv.Atoi(portValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q for path %q", portValue, path)
+		}
+		found := false
+		for _, servicePort := range ports {
+			if servicePort.Port == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("port %d for path %q is not one of the service ports", port, path)
+		}
+
+		seen[path] = true
+		pathPorts = append(pathPorts, pathPort{Path: path, Port: port})
+	}
+
+	return pathPorts, nil
+}
+
+// parseConditionsFromQuery returns the endpoint conditions, ready and
+// serving unless overridden by ready=, serving= and terminating= query
+// parameters, e.g. ready=false&terminating=true to drain a backend
+func parseConditionsFromQuery(query url.Values) (IcanhazlbEndpointConditions, error) {
+	conditions := IcanhazlbEndpointConditions{Ready: true, Serving: true}
+	for name, condition := range map[string]*bool{
+		"ready":       &conditions.Ready,
+		"serving":     &conditions.Serving,
+		"terminating": &conditions.Terminating,
+	} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return IcanhazlbEndpointConditions{}, fmt.Errorf("invalid %s value %q", name, value)
+		}
+		*condition = parsed
+	}
+	return conditions, nil
+}
+
+// checkAnnotationsAllowed refuses requested annotations whose keys aren't
+// in allowed, since annotations such as nginx's configuration-snippet can
+// change how the ingress controller serves every host
+func checkAnnotationsAllowed(annotations map[string]string, allowed []string) error {
+	var refused []string
+	for key := range annotations {
+		if !slices.Contains(allowed, key) {
+			refused = append(refused, key)
+		}
+	}
+	if len(refused) > 0 {
+		slices.Sort(refused)
+		return fmt.Errorf("annotations not allowed: %s", strings.Join(refused, ", "))
+	}
+	return nil
+}
+
+// parseAliasesFromQuery returns the alternate hostnames from comma-separated
+// aliases= query parameters, de-duplicated against each other and hostname
+func parseAliasesFromQuery(query url.Values, hostname string) ([]string, error) {
+	var aliases []string
+	seen := map[string]bool{hostname: true}
+
+	for _, value := range query["aliases"] {
+		for _, alias := range splitCommaList(value) {
+			alias = strings.ToLower(alias)
+			if seen[alias] {
+				continue
+			}
+
+			errs := validation.IsDNS1123Subdomain(alias)
+			if strings.HasPrefix(alias, "*.") {
+				errs = validation.IsWildcardDNS1123Subdomain(alias)
+			}
+			if len(errs) > 0 {
+				return nil, fmt.Errorf("invalid alias %q: %s", alias, strings.Join(errs, ", "))
+			}
+
+			seen[alias] = true
+			aliases = append(aliases, alias)
+		}
+	}
+
+	return aliases, nil
+}
+
+// parseKeyValuesFromQuery collects repeated <param>=key:value query
+// parameters into a map, validating each key as a qualified name
+func parseKeyValuesFromQuery(query url.Values, param string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, value := range query[param] {
+		key, val, found := strings.Cut(value, ":")
+		if !found {
+			return nil, fmt.Errorf("%s %q must be in key:value form", param, value)
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid %s key %q: %s", param, key, strings.Join(errs, ", "))
+		}
+		values[key] = val
+	}
+	return values, nil
+}
+
+// fieldError describes one invalid request parameter
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors accumulates the invalid parameters of a request
+type fieldErrors []fieldError
+
+func (e *fieldErrors) add(field string, err error) {
+	*e = append(*e, fieldError{Field: field, Message: err.Error()})
+}
+
+func (e fieldErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		messages = append(messages, fmt.Sprintf("%s: %s", fieldErr.Field, fieldErr.Message))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// writeFieldErrors responds with 400 and every invalid parameter, keeping
+// the error message for clients that only read that
+func writeFieldErrors(w http.ResponseWriter, invalid fieldErrors) {
+	writeJSONErrorDetails(w, fmt.Sprintf("Invalid request parameters: %v", invalid), http.StatusBadRequest, map[string]interface{}{
+		"errors": invalid,
+	})
+}
+
+// parseClusterIP returns the cluster IP requested for the service, either an
+// address or None for a headless service, which headless is shorthand for.
+// Empty leaves the cluster to allocate one.
+func parseClusterIP(value string, headless bool, serviceType string) (string, error) {
+	if headless {
+		if value != "" && value != "None" {
+			return "", fmt.Errorf("cluster IP %q conflicts with headless", value)
+		}
+		value = "None"
+	}
+	if value == "" {
+		return "", nil
+	}
+
+	if serviceType == "ExternalName" {
+		return "", fmt.Errorf("%s services have no cluster IP", serviceType)
+	}
+	if value == "None" {
+		if serviceType != "ClusterIP" {
+			return "", fmt.Errorf("%s services can't be headless", serviceType)
+		}
+		return value, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid cluster IP %q: must be an IP address or None", value)
+	}
+	return ip.String(), nil
+}
+
+// parseBoolParam returns the boolean query parameter name, or fallback when
+// it is absent or invalid, adding any error to invalid
+func parseBoolParam(query url.Values, name string, fallback bool, invalid *fieldErrors) bool {
+	value := query.Get(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		invalid.add(name, err)
+		return fallback
+	}
+	return parsed
+}
+
+// writeJSONError replies to the request with a JSON error body, as a JSON
+// counterpart to http.Error
+func writeJSONError(w http.ResponseWriter, message string, code int) {
+	writeJSONErrorDetails(w, message, code, nil)
+}
+
+// writeJSONErrorDetails is writeJSONError with extra fields in the body
+func writeJSONErrorDetails(w http.ResponseWriter, message string, code int, details map[string]interface{}) {
+	body := map[string]interface{}{}
+	for key, value := range details {
+		body[key] = value
+	}
+	body["error"] = message
+	body["code"] = code
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// requestedHostname returns the hostname given in an /ip/{hostname} path,
+// such as /ip/10-0-0-5, or otherwise the one from the Host header. A bare
+// IP or label in the path is qualified with bareHostname, as /bulk does.
+func requestedHostname(r *http.Request, config Config) string {
+	if pathHostname, found := strings.CutPrefix(r.URL.Path, ipPathPrefix); found {
+		return bareHostname(strings.Trim(pathHostname, "/"), config.BaseDomain)
+	}
+	return extractHostnameFromRequest(r, config.TrustForwardedHeaders)
+}
+
+// bareHostname turns a bare IP or single DNS label, such as 10.0.0.5 or
+// 10-0-0-5, into a hostname under baseDomain like 10-0-0-5.example.com, so
+// it can be used as an ingress host. Without a base domain the IP is only
+// dash-encoded. Full hostnames are returned unchanged.
+func bareHostname(hostname, baseDomain string) string {
+	if ip := net.ParseIP(hostname); ip != nil {
+		hostname = strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	}
+	if baseDomain == "" || strings.Contains(hostname, ".") {
+		return hostname
+	}
+	return hostname + "." + strings.Trim(baseDomain, ".")
+}
+
+func extractHostnameFromRequest(r *http.Request, trustForwardedHeaders bool) string {
+	host := r.Host
+
+	// Behind a proxy the externally requested host is only available in the
+	// forwarded headers, which are only trusted when explicitly enabled. The
+	// standard Forwarded header takes precedence over X-Forwarded-Host.
+	if trustForwardedHeaders {
+		if forwardedHost := parseForwardedHost(strings.Join(r.Header.Values("Forwarded"), ",")); forwardedHost != "" {
+			host = forwardedHost
+		} else if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			// Use the first entry, set by the proxy closest to the client
+			host = strings.TrimSpace(strings.SplitN(forwardedHost, ",", 2)[0])
+		}
+	}
+
+	hostname := strings.SplitN(host, ":", 2)[0]
+	return hostname
+}
+
+// checkHostnameLimits checks hostname is within the DNS limits on name and
+// label length, and the configured maximums. The hostname isn't quoted in
+// errors, as it may be huge.
+func checkHostnameLimits(config Config, hostname string) error {
+	name := strings.TrimSuffix(hostname, ".")
+	if len(name) > config.MaxHostnameLength {
+		return fmt.Errorf("hostname is %d characters long, more than the maximum of %d", len(name), config.MaxHostnameLength)
+	}
+
+	labels := strings.Split(name, ".")
+	if config.MaxHostnameLabels > 0 && len(labels) > config.MaxHostnameLabels {
+		return fmt.Errorf("hostname has %d labels, more than the maximum of %d", len(labels), config.MaxHostnameLabels)
+	}
+	for i, label := range labels {
+		if len(label) > validation.DNS1123LabelMaxLength {
+			return fmt.Errorf("hostname label %d is %d characters long, more than the maximum of %d", i+1, len(label), validation.DNS1123LabelMaxLength)
+		}
+	}
+	return nil
+}
+
+// hostnameInDomain reports whether hostname is domain or a subdomain of it
+func hostnameInDomain(hostname, domain string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
+
+// parseForwardedHost returns the host parameter of the first element of an
+// RFC 7239 Forwarded header that has one, e.g. example.com from
+// "for=192.0.2.60;host=example.com, for=198.51.100.17"
+func parseForwardedHost(header string) string {
+	for _, element := range splitForwarded(header, ',') {
+		for _, pair := range splitForwarded(element, ';') {
+			key, value, found := strings.Cut(pair, "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(key), "host") {
+				continue
+			}
+
+			value = strings.TrimSpace(value)
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			if value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// splitForwarded splits a Forwarded header value on sep, ignoring any
+// separators within quoted strings
+func splitForwarded(value string, sep byte) []string {
+	var parts []string
+	inQuotes, escaped, start := false, false, 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes && value[i] == '\\':
+			escaped = true
+		case value[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && value[i] == sep:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// checkSpecialIP rejects addresses that can't usefully back a service, such
+// as loopback addresses which would point at the node or pod itself
+func checkSpecialIP(ip net.IP) error {
+	switch {
+	case ip.IsUnspecified():
+		return fmt.Errorf("%s is an unspecified address", ip)
+	case ip.IsLoopback():
+		return fmt.Errorf("%s is a loopback address", ip)
+	case ip.IsMulticast():
+		return fmt.Errorf("%s is a multicast address", ip)
+	case ip.IsLinkLocalUnicast():
+		return fmt.Errorf("%s is a link-local address", ip)
+	}
+	return nil
+}
+
+// checkIPAllowed rejects IPs within any deny range or, when allow ranges
+// are configured, outside all of them
+func checkIPAllowed(ip net.IP, allow, deny []*net.IPNet) error {
+	for _, cidr := range deny {
+		if cidr.Contains(ip) {
+			return fmt.Errorf("%s is within denied range %s", ip, cidr)
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, cidr := range allow {
+		if cidr.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not within any allowed range", ip)
+}
+
+// requestingClient identifies the client for the created-by annotation and
+// rate limiting, preferring the original client from X-Forwarded-For when trusted
+func requestingClient(r *http.Request, trustForwardedHeaders bool) string {
+	client := clientIPFromRequest(r)
+	if trustForwardedHeaders {
+		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			client = strings.TrimSpace(strings.SplitN(forwardedFor, ",", 2)[0])
+		}
+	}
+
+	// The header is client controlled, so only keep characters that can
+	// appear in an address and bound the length
+	client = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("0123456789abcdefABCDEF.:[]", r) {
+			return r
+		}
+		return -1
+	}, client)
+	if len(client) > maxCreatedByLength {
+		client = client[:maxCreatedByLength]
+	}
+	return client
+}
+
+func clientIPFromRequest(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// namespaceFromHostname returns the namespace in the first capture group of
+// re's match in hostname, or an empty string if it doesn't match
+func namespaceFromHostname(re *regexp.Regexp, hostname string) (string, error) {
+	match := re.FindStringSubmatch(hostname)
+	if len(match) < 2 || match[1] == "" {
+		return "", nil
+	}
+
+	namespace := strings.ToLower(match[1])
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return "", fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, ", "))
+	}
+	return namespace, nil
+}
+
+// parseFQDNBackend normalises a backend DNS name, checking it is a valid
+// domain name that still fits in the generated object names
+func parseFQDNBackend(config Config, value string) (string, error) {
+	fqdn := strings.ToLower(strings.TrimSuffix(value, "."))
+	// Dash-encoded IPs are refused too, so a name can't pass for one
+	dashedIPv4, dashedIPv6 := strings.ReplaceAll(fqdn, "-", "."), strings.ReplaceAll(fqdn, "-", ":")
+	if net.ParseIP(fqdn) != nil || net.ParseIP(dashedIPv4) != nil || net.ParseIP(dashedIPv6) != nil {
+		return "", fmt.Errorf("%q is an IP address, put it in the hostname instead", value)
+	}
+	if errs := validation.IsDNS1123Subdomain(fqdn); len(errs) > 0 {
+		return "", fmt.Errorf("invalid FQDN %q: %s", value, strings.Join(errs, ", "))
+	}
+
+	if errs := validation.IsDNS1035Label(serviceName(config, fqdnFriendlyName(fqdn))); len(errs) > 0 {
+		return "", fmt.Errorf("FQDN %q is too long for the generated service name: %s", value, strings.Join(errs, ", "))
+	}
+	return fqdn, nil
+}
+
+// fqdnFriendlyName converts an FQDN backend into the name segment of its
+// objects. The fqdn- prefix keeps them apart from objects named after an IP,
+// which never contain a q or n.
+func fqdnFriendlyName(fqdn string) string {
+	return "fqdn-" + strings.ReplaceAll(fqdn, ".", "-")
+}
+
+// resolveFQDN looks up the IPv4 addresses an FQDN backend currently has,
+// giving up after timeout
+func resolveFQDN(ctx context.Context, fqdn string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", fqdn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", fqdn, err)
+	}
+
+	// Sort the addresses so repeated lookups produce the same endpoints
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	slices.Sort(addresses)
+	addresses = slices.Compact(addresses)
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%s has no IPv4 addresses", fqdn)
+	}
+	return addresses, nil
+}
+
+// Regular expression pattern for a single IPv4 octet group in a hostname
+var ipv4OctetRE = regexp.MustCompile(`^\d{1,3}$`)
+
+// findIPv4 returns the first run of exactly four octet groups in hostname,
+// separated by dots, dashes or underscores, and the offset it starts at, or
+// -1 if there is none. Working on whole groups rather than a bare digit
+// pattern means a prefix label such as app- in app-10-0-0-5, or digits
+// glued to it as in app1-10-0-0-5, is never taken as the first octet.
+func findIPv4(hostname string) (string, int) {
+	var groups []int
+	start := 0
+	for i := 0; i <= len(hostname); i++ {
+		if i < len(hostname) && !strings.ContainsRune("-_.", rune(hostname[i])) {
+			continue
+		}
+		if ipv4OctetRE.MatchString(hostname[start:i]) {
+			groups = append(groups, start)
+			if len(groups) == 4 {
+				return hostname[groups[0]:i], groups[0]
+			}
+		} else {
+			groups = groups[:0]
+		}
+		start = i + 1
+	}
+	return "", -1
+}
+
+// hostnameForIP returns the part of hostname searched for the IP address,
+// which in leftmost mode is only the first DNS label
+func hostnameForIP(hostname, position string) string {
+	if position == ipLabelLeftmost {
+		label, _, _ := strings.Cut(hostname, ".")
+		return label
+	}
+	return hostname
+}
+
+func parseIPAddressFromHostname(hostname, position string) (string, error) {
+	search := hostnameForIP(hostname, position)
+
+	// Look for a DNS label holding a dash-encoded IPv6 address first, since
+	// a fully expanded IPv6 label can otherwise be mistaken for IPv4 octets
+	if ip := parseIPv6AddressFromHostname(search); ip != "" {
+		return ip, nil
+	}
+
+	// Find the four octet groups of the IP address
+	if match, _ := findIPv4(search); match != "" {
+		// Remove any non-numeric characters from the matched IP address
+		ip := strings.Map(func(r rune) rune {
+			if r == '-' || r == '_' || r == '.' {
+				return '.'
+			}
+			return r
+		}, match)
+
+		// Octet groups allow any 1-3 digits, so check each octet's range to
+		// explain exactly why an address like 300-1-1-1 is rejected
+		for _, octet := range strings.Split(ip, ".") {
+			if value, err := strconv.Atoi(octet); err != nil || value > 255 {
+				return "", fmt.Errorf("octet %s of %q in hostname %q is out of range 0-255", octet, match, hostname)
+			}
+		}
+
+		// Validate and return the parsed IPv4 address, converting to the
+		// 4-byte form only once and checking it before use
+		parsedIP := net.ParseIP(ip)
+		if parsedIP == nil {
+			return "", fmt.Errorf("%q in hostname %q is not a valid IPv4 address", match, hostname)
+		}
+		ipv4 := parsedIP.To4()
+		if ipv4 == nil {
+			return "", fmt.Errorf("%q in hostname %q is not an IPv4 address", match, hostname)
+		}
+		return ipv4.String(), nil
+	}
+
+	return "", fmt.Errorf("no IPv4 or IPv6 address could be parsed from hostname %q", hostname)
+}
+
+func parseIPv6AddressFromHostname(hostname string) string {
+	// Regular expression pattern for matching a dash-encoded IPv6 label,
+	// e.g. 2001-db8--1 for 2001:db8::1
+	ipv6RE := `^[0-9a-fA-F]{0,4}(-[0-9a-fA-F]{0,4}){2,7}$`
+
+	re := regexp.MustCompile(ipv6RE)
+	for _, label := range strings.Split(hostname, ".") {
+		if !re.MatchString(label) {
+			continue
+		}
+
+		// Restore the colons and validate the parsed IPv6 address
+		parsedIP := net.ParseIP(strings.ReplaceAll(label, "-", ":"))
+		if parsedIP == nil || parsedIP.To4() != nil {
+			continue
+		}
+		return parsedIP.String()
+	}
+
+	return ""
+}
+
+// ipLabelIndex returns the index of the DNS label where the IP address in
+// hostname starts, or -1 if there is none
+func ipLabelIndex(hostname string) int {
+	labels := strings.Split(hostname, ".")
+	if ip := parseIPv6AddressFromHostname(hostname); ip != "" {
+		for i, label := range labels {
+			if parseIPv6AddressFromHostname(label) == ip {
+				return i
+			}
+		}
+	}
+
+	_, start := findIPv4(hostname)
+	if start < 0 {
+		return -1
+	}
+	return strings.Count(hostname[:start], ".")
+}
+
+// collapseSubdomains returns the wildcard host covering all subdomains of the
+// IP address in hostname, along with the bare IP host the wildcard doesn't
+// match. Both are the same whichever of them was requested, so the object's
+// rules don't change between requests. A hostname without an IP is returned
+// as is, with no bare host.
+func collapseSubdomains(hostname string) (wildcard, bare string) {
+	index := ipLabelIndex(hostname)
+	if index < 0 {
+		return hostname, ""
+	}
+	labels := strings.Split(hostname, ".")
+	bare = strings.Join(labels[index:], ".")
+	return "*." + bare, bare
+}
+
+// withBareHost puts the bare IP host from collapseSubdomains ahead of the
+// requested aliases, so it gets its own ingress rule next to the wildcard
+func withBareHost(aliases []string, bare string) []string {
+	if bare == "" || slices.Contains(aliases, bare) {
+		return aliases
+	}
+	return append([]string{bare}, aliases...)
+}
+
+func parsePortFromHostname(ctx context.Context, hostname string) int {
+	// The port trails dash or underscore separated IPv4 octets, e.g.
+	// 10-0-0-5-8080, so only look directly after the address findIPv4 found
+	address, start := findIPv4(hostname)
+	if start < 0 || strings.Contains(address, ".") {
+		return 0
+	}
+
+	// Regular expression pattern for matching the port after the last octet
+	portRE := `^[-_](\d{1,5})(?:$|[^\d])`
+
+	re := regexp.MustCompile(portRE)
+	match := re.FindStringSubmatch(hostname[start+len(address):])
+	if match == nil {
+		return 0
+	}
+
+	port, err := strconv.Atoi(match[1])
+	if err != nil || len(validation.IsValidPortNum(port)) > 0 {
+		slog.WarnContext(ctx, "Ignoring invalid port in hostname", "hostname", hostname, "port", match[1])
+		return 0
+	}
+	return port
+}
+
+func ipFamilyForAddress(ipAddress string) string {
+	parsedIP := net.ParseIP(ipAddress)
+	if parsedIP != nil && parsedIP.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// ipFamiliesForPolicy lists the service IP families for an address family,
+// adding the other family second when the policy asks for dual stack
+func ipFamiliesForPolicy(ipFamily, policy string) []string {
+	if policy == "SingleStack" {
+		return []string{ipFamily}
+	}
+	if ipFamily == "IPv6" {
+		return []string{"IPv6", "IPv4"}
+	}
+	return []string{"IPv4", "IPv6"}
+}
+
+// objectName returns the IcanhazlbService name for an IP
+func objectName(config Config, svcFriendlyIp string) string {
+	return fmt.Sprintf("%s-%s", config.NamePrefix, svcFriendlyIp)
+}
+
+// validateObjectName checks a generated IcanhazlbService name is one the API
+// server accepts, which those for addresses ending in ::, such as
+// 2001:db8::, are not
+func validateObjectName(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("generated name %q is invalid: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// serviceName returns the name of the Service generated for an IP, which is
+// also the EndpointSlice's kubernetes.io/service-name label
+func serviceName(config Config, svcFriendlyIp string) string {
+	return objectName(config, svcFriendlyIp) + "-svc"
+}
+
+// ingressName returns the name of the Ingress generated for an IP
+func ingressName(config Config, svcFriendlyIp string) string {
+	return objectName(config, svcFriendlyIp) + "-ing"
+}
+
+// tlsSecretName derives the ingress TLS secret name from the host, e.g.
+// *.10-0-0-5.example.com becomes wildcard-10-0-0-5-example-com-tls
+func tlsSecretName(config Config, hostname string) string {
+	name := strings.NewReplacer("*", "wildcard", ".", "-").Replace(hostname)
+	return name + config.IngressTLSSecretSuffix
+}
+
+// applyDefaultObjectMeta adds the default labels and annotations to meta,
+// keeping any value already set such as the created-by annotation
+func applyDefaultObjectMeta(meta *v1.ObjectMeta, labels, annotations map[string]string) {
+	for key, value := range labels {
+		if meta.Labels == nil {
+			meta.Labels = map[string]string{}
+		}
+		if _, ok := meta.Labels[key]; !ok {
+			meta.Labels[key] = value
+		}
+	}
+	for key, value := range annotations {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		if _, ok := meta.Annotations[key]; !ok {
+			meta.Annotations[key] = value
+		}
+	}
+}
+
+// crdRequest holds the per-request inputs used to build an IcanhazlbService
+type crdRequest struct {
+	IPAddress     string
+	Hostname      string
+	SvcFriendlyIp string
+	Ports         []IcanhazlbPort
+	TargetPorts   []IcanhazlbPort
+	Annotations   map[string]string
+	Labels        map[string]string
+	Addresses     []string
+	CreatedBy     string
+	DryRun        bool
+	Aliases       []string
+	FQDN          bool
+	Conditions    IcanhazlbEndpointConditions
+	PathPorts     []pathPort
+	NoIngress     bool
+	ClusterIP     string
+}
+
+// pathPort routes an ingress path to a service port
+type pathPort struct {
+	Path string
+	Port int
+}
+
+type createCRDResult struct {
+	icanhazlbService *IcanhazlbService
+	created          bool
+}
+
+// createCRDOnce calls createCRDInKubernetes, sharing the result between
+// concurrent identical requests so that a burst of requests for a new host
+// doesn't race to create the same object. The shared call runs on its own
+// context, keeping the first caller's values but not its cancellation, so one
+// client disconnecting doesn't fail every request waiting on the call.
+func createCRDOnce(ctx context.Context, group *singleflight.Group, dynamicClient dynamic.Interface, recorder record.EventRecorder, config Config, req crdRequest) (*IcanhazlbService, bool, error) {
+	// The requesting client doesn't change the spec, so leave it out of the
+	// key to let requests from different clients collapse too
+	keyReq := req
+	keyReq.CreatedBy = ""
+	key, err := json.Marshal(keyReq)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to build request key: %v", err)
+	}
+
+	results := group.DoChan(config.Namespace+"/"+string(key), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), config.K8sTimeout)
+		defer cancel()
+
+		icanhazlbService, created, err := createCRDInKubernetes(ctx, dynamicClient, config, req)
+
+		// Leave an audit trail on the object for kubectl describe
+		if !req.DryRun {
+			ref := serviceReference(config, objectName(config, req.SvcFriendlyIp))
+			switch {
+			case err != nil:
+				recorder.Eventf(ref, corev1.EventTypeWarning, "CreateFailed", "Failed to create for %s: %v", req.Hostname, err)
+			case created:
+				recorder.Eventf(ref, corev1.EventTypeNormal, "Created", "Created for %s by %s", req.Hostname, req.CreatedBy)
+			default:
+				recorder.Eventf(ref, corev1.EventTypeNormal, "Updated", "Updated for %s by %s", req.Hostname, req.CreatedBy)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			crdCreationsTotal.With(crdMetricLabels(config)).Inc()
+			crdsCreated.Add(1)
+			activeServices.Add(1)
+
+			if config.NotifyWebhookURL != "" {
+				notifyWebhook(ctx, config.NotifyWebhookURL, webhookNotification{
+					Hostname:  req.Hostname,
+					IPAddress: req.IPAddress,
+					Name:      icanhazlbService.Name,
+					Namespace: icanhazlbService.Namespace,
+					Timestamp: time.Now().UTC(),
+				})
+			}
+		}
+		return createCRDResult{icanhazlbService, created}, nil
+	})
+
+	// Each caller still gives up when its own context is done
+	var result singleflight.Result
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case result = <-results:
+	}
+	if result.Err != nil {
+		return nil, false, result.Err
+	}
+
+	createResult := result.Val.(createCRDResult)
+	return createResult.icanhazlbService, createResult.created, nil
+}
+
+func createCRDInKubernetes(ctx context.Context, dynamicClient dynamic.Interface, config Config, req crdRequest) (*IcanhazlbService, bool, error) {
+	ipAddress, hostname, svcFriendlyIp := req.IPAddress, req.Hostname, req.SvcFriendlyIp
+
+	ipFamily := ipFamilyForAddress(ipAddress)
+	addressType := ipFamily
+	if req.FQDN {
+		addressType = "FQDN"
+	}
+
+	// Only node-exposed services route external traffic, and ExternalName
+	// services don't proxy at all
+	externalTrafficPolicy, sessionAffinity := "", ""
+	if config.ServiceType == "NodePort" || config.ServiceType == "LoadBalancer" {
+		externalTrafficPolicy = config.ExternalTrafficPolicy
+	}
+	if config.ServiceType != "ExternalName" {
+		sessionAffinity = config.SessionAffinity
+	}
+
+	// Each backend address gets its own endpoint so traffic is balanced
+	// across all of them
+	addresses := req.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{ipAddress}
+	}
+	endpoints := make([]IcanhazlbEndpoint, 0, len(addresses))
+	for _, address := range addresses {
+		endpoints = append(endpoints, IcanhazlbEndpoint{Addresses: []string{address}, Conditions: req.Conditions})
+	}
+
+	// Request labels override the defaults, but never the service-name
+	// label which ties the EndpointSlice to the Service
+	labels := map[string]string{}
+	for key, value := range config.DefaultLabels {
+		labels[key] = value
+	}
+	for key, value := range req.Labels {
+		labels[key] = value
+	}
+	templateData := annotationTemplateData{
+		IP:       ipAddress,
+		Hostname: hostname,
+		Name:     objectName(config, svcFriendlyIp),
+	}
+	names, err := renderObjectNames(config, templateData, svcFriendlyIp)
+	if err != nil {
+		return nil, false, err
+	}
+	labels["kubernetes.io/service-name"] = names.service
+
+	// Configured annotations may embed the request details as templates
+	ingressAnnotations, err := renderAnnotations(config, templateData)
+	if err != nil {
+		return nil, false, err
+	}
+	// Annotations set by their own flags are only defaults, so configured
+	// ones win
+	for key, enabled := range map[string]bool{
+		sslRedirectAnnotation:      config.SSLRedirect,
+		forceSSLRedirectAnnotation: config.ForceSSLRedirect,
+	} {
+		if _, ok := ingressAnnotations[key]; enabled && !ok {
+			ingressAnnotations[key] = "true"
+		}
+	}
+	for key, value := range map[string]string{
+		backendProtocolAnnotation: config.BackendProtocol,
+		upstreamVhostAnnotation:   config.UpstreamVhost,
+	} {
+		if _, ok := ingressAnnotations[key]; value != "" && !ok {
+			ingressAnnotations[key] = value
+		}
+	}
+	if config.IngressTLS && config.IngressClusterIssuer != "" {
+		ingressAnnotations["cert-manager.io/cluster-issuer"] = config.IngressClusterIssuer
+	}
+	// Requests can only add annotations, never replace the operator's
+	for key, value := range req.Annotations {
+		if _, ok := ingressAnnotations[key]; !ok {
+			ingressAnnotations[key] = value
+		}
+	}
+
+	// Backends listen on the service ports unless given target ports
+	endpointPorts := req.TargetPorts
+	if len(endpointPorts) == 0 {
+		endpointPorts = req.Ports
+	}
+
+	// Without path mappings everything goes to the first port
+	pathPorts := req.PathPorts
+	if len(pathPorts) == 0 {
+		pathPorts = []pathPort{{Path: config.DefaultPath, Port: req.Ports[0].Port}}
+	}
+	paths := make([]IcanhazlbHTTPPath, 0, len(pathPorts))
+	for _, pathPort := range pathPorts {
+		paths = append(paths, IcanhazlbHTTPPath{
+			Path:     pathPort.Path,
+			PathType: config.DefaultPathType,
+			Backend: IcanhazlbHTTPBackend{
+				Service: IcanhazlbHTTPServiceBackend{
+					Name: names.service,
+					Port: IcanhazlbBackendPort{
+						Number: intstr.FromInt(pathPort.Port),
+					},
+				},
+			},
+		})
+	}
+
+	// Route the request host and any aliases to the same backend
+	hosts := append([]string{hostname}, req.Aliases...)
+	ingressRules := make([]IcanhazlbIngressRule, 0, len(hosts))
+	for _, host := range hosts {
+		ingressRules = append(ingressRules, IcanhazlbIngressRule{
+			Host: host,
+			HTTP: IcanhazlbHTTP{
+				Paths: paths,
+			},
+		})
+	}
+
+	// Terminate TLS at the ingress with a certificate for the request host
+	// and its aliases
+	var ingressTLS []IcanhazlbIngressTLS
+	if config.IngressTLS {
+		ingressTLS = []IcanhazlbIngressTLS{
+			{
+				Hosts:      hosts,
+				SecretName: tlsSecretName(config, hostname),
+			},
+		}
+	}
+
+	icanhazlbService := &IcanhazlbService{
+		TypeMeta: v1.TypeMeta{
+			APIVersion: fmt.Sprintf("%s/%s", icanhazlbAPIGroup, icanhazlbAPIVersion),
+			Kind:       "IcanhazlbService",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      objectName(config, svcFriendlyIp),
+			Namespace: config.Namespace,
+			// Record the request's forms of the address so consumers can
+			// reconstruct it
+			Annotations: map[string]string{
+				createdByAnnotation:     req.CreatedBy,
+				ipAddressAnnotation:     ipAddress,
+				svcFriendlyIPAnnotation: svcFriendlyIp,
+				hostnameAnnotation:      hostname,
+			},
+		},
+		Spec: IcanhazlbServiceSpec{
+			EndpointSlices: IcanhazlbEndpointSlices{
+				Name:        names.endpointSlice,
+				AddressType: addressType,
+				Ports:       endpointPorts,
+				Endpoints:   endpoints,
+				Labels:      labels,
+			},
+			Services: IcanhazlbServices{
+				Name:                  names.service,
+				Type:                  config.ServiceType,
+				IPFamilies:            ipFamiliesForPolicy(ipFamily, config.IPFamilyPolicy),
+				IPFamilyPolicy:        config.IPFamilyPolicy,
+				ExternalTrafficPolicy: externalTrafficPolicy,
+				SessionAffinity:       sessionAffinity,
+				ClusterIP:             req.ClusterIP,
+				Ports:                 req.Ports,
+				Labels:                labels,
+			},
+			Ingresses: &IcanhazlbIngresses{
+				Name:             names.ingress,
+				Annotations:      ingressAnnotations,
+				IngressClassName: config.IngressClassName,
+				TLS:              ingressTLS,
+				Rules:            ingressRules,
+			},
+		},
+	}
+	applyDefaultObjectMeta(&icanhazlbService.ObjectMeta, config.ObjectLabels, config.ObjectAnnotations)
+	icanhazlbService.OwnerReferences = config.owner.ownerReferencesFor(config.Namespace)
+
+	// Consumers routing traffic themselves only need the service and
+	// EndpointSlice
+	if req.NoIngress {
+		icanhazlbService.Spec.Ingresses = nil
+	}
+
+	if req.DryRun {
+		return icanhazlbService, false, nil
+	}
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(icanhazlbService)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to convert CRD: %v", err)
+	}
+
+	resource := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(config.Namespace)
+
+	// Retry transient API errors with backoff, surfacing the last error
+	// once the retries are exhausted
+	var stored *unstructured.Unstructured
+	created := false
+	err = retry.OnError(retry.DefaultBackoff, isRetryableError, func() error {
+		var err error
+		stored, created, err = upsertCRD(ctx, resource, object, config.ConflictRetries)
+		if err != nil && isRetryableError(err) {
+			slog.WarnContext(ctx, "Retrying CRD upsert", "name", icanhazlbService.Name, "error", err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Return the object as stored, with the server-assigned metadata such
+	// as the UID and resourceVersion
+	result := &IcanhazlbService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(stored.Object, result); err != nil {
+		return nil, false, fmt.Errorf("failed to convert created CRD: %v", err)
+	}
+
+	return result, created, nil
+}
+
+// upsertCRD creates the desired object, or updates the existing object to
+// the desired state rather than failing with AlreadyExists
+func upsertCRD(ctx context.Context, resource dynamic.ResourceInterface, object map[string]interface{}, conflictRetries int) (*unstructured.Unstructured, bool, error) {
+	desired := &unstructured.Unstructured{Object: object}
+	name := desired.GetName()
+
+	start := time.Now()
+	existing, err := resource.Get(ctx, name, v1.GetOptions{})
+	k8sRequestDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+	if err == nil {
+		updated, err := updateCRDSpecOnConflict(ctx, resource, existing, object, conflictRetries)
+		return updated, false, err
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, false, fmt.Errorf("failed to get CRD %s: %w", name, err)
+	}
+
+	// Any non-2xx response from the API server comes back as an error
+	// carrying the status code and the server's message
+	start = time.Now()
+	created, err := resource.Create(ctx, desired, v1.CreateOptions{})
+	k8sRequestDuration.WithLabelValues("create").Observe(time.Since(start).Seconds())
+	if err != nil {
+		if code := apiStatusCode(err); code != 0 {
+			return nil, false, fmt.Errorf("failed to create CRD %s: API server returned %d: %w", name, code, err)
+		}
+		return nil, false, fmt.Errorf("failed to create CRD %s: %w", name, err)
+	}
+
+	slog.DebugContext(ctx, "Created CRD", "name", name, "outcome", "created")
+	return created, true, nil
+}
+
+// apiStatusCode returns the HTTP status code of a Kubernetes API error, or
+// 0 if the request never got a response
+func apiStatusCode(err error) int32 {
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		return status.Status().Code
+	}
+	return 0
+}
+
+// isRetryableError reports whether a Kubernetes API error is likely to be
+// transient. AlreadyExists is included as it means the object was created
+// concurrently and a retry will update it instead. Conflicts are retried by
+// the update itself, within its own bound.
+func isRetryableError(err error) bool {
+	return apierrors.IsAlreadyExists(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err)
+}
+
+// updateCRDSpecOnConflict updates the spec of an existing object, refetching
+// it and trying again when someone else updated it in the meantime
+func updateCRDSpecOnConflict(ctx context.Context, resource dynamic.ResourceInterface, existing *unstructured.Unstructured, desired map[string]interface{}, conflictRetries int) (*unstructured.Unstructured, error) {
+	name := existing.GetName()
+	backoff := retry.DefaultRetry
+	backoff.Steps = conflictRetries + 1
+
+	var updated *unstructured.Unstructured
+	attempts := 0
+	err := retry.RetryOnConflict(backoff, func() error {
+		attempts++
+		if attempts > 1 {
+			start := time.Now()
+			latest, err := resource.Get(ctx, name, v1.GetOptions{})
+			k8sRequestDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+			if err != nil {
+				return fmt.Errorf("failed to get CRD %s: %w", name, err)
+			}
+			existing = latest
+			slog.DebugContext(ctx, "Retrying CRD update after conflict", "name", name, "attempt", attempts)
+		}
+
+		var err error
+		updated, err = updateCRDSpec(ctx, resource, existing, desired)
+		return err
+	})
+	if apierrors.IsConflict(err) {
+		return nil, fmt.Errorf("failed to update CRD %s: still conflicting after %d attempts: %w", name, attempts, err)
+	}
+	return updated, err
+}
+
+// updateCRDSpec reconciles the spec of an existing object to the desired one
+func updateCRDSpec(ctx context.Context, resource dynamic.ResourceInterface, existing *unstructured.Unstructured, desired map[string]interface{}) (*unstructured.Unstructured, error) {
+	existing.Object["spec"] = desired["spec"]
+
+	start := time.Now()
+	updated, err := resource.Update(ctx, existing, v1.UpdateOptions{})
+	k8sRequestDuration.WithLabelValues("update").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to update CRD %s: %w", existing.GetName(), err)
+	}
+
+	return updated, nil
+}
+
+func deleteCRDInKubernetes(ctx context.Context, dynamicClient dynamic.Interface, config Config, svcFriendlyIp string) error {
+	name := objectName(config, svcFriendlyIp)
+
+	start := time.Now()
+	err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(config.Namespace).
+		Delete(ctx, name, v1.DeleteOptions{})
+	k8sRequestDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to delete CRD %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// listNamespace returns the namespace holding our IcanhazlbServices, or all
+// namespaces when each tenant's is picked from their hostname
+func listNamespace(config Config) string {
+	if config.namespaceRegex != nil {
+		return v1.NamespaceAll
+	}
+	return config.Namespace
+}
+
+// errServiceLimitReached is returned by checkServiceLimit when creating
+// another IcanhazlbService would exceed the configured maximum
+var errServiceLimitReached = errors.New("maximum number of services reached")
+
+// checkServiceLimit counts the IcanhazlbServices with our name prefix in the
+// namespace, returning errServiceLimitReached if there are already the
+// maximum and name isn't one of them. With a namespace regex callers pick
+// the namespace, so the count then spans all namespaces to stay a hard cap.
+// Concurrent creates may still overshoot the limit slightly.
+func checkServiceLimit(ctx context.Context, dynamicClient dynamic.Interface, config Config, name string) (int, error) {
+	listConfig := config
+	listConfig.Namespace = listNamespace(config)
+	icanhazlbServices, err := listCRDsInKubernetes(ctx, dynamicClient, listConfig)
+	if err != nil {
+		return 0, err
+	}
+
+	count, exists := 0, false
+	for _, icanhazlbService := range icanhazlbServices {
+		if strings.HasPrefix(icanhazlbService.Name, config.NamePrefix+"-") {
+			count++
+		}
+		exists = exists || (icanhazlbService.Name == name && icanhazlbService.Namespace == config.Namespace)
+	}
+
+	// Updating an existing object doesn't add another
+	if count >= config.MaxServices && !exists {
+		return count, errServiceLimitReached
+	}
+	return count, nil
+}
+
+// ensureNamespace creates namespace if it doesn't already exist
+func ensureNamespace(ctx context.Context, clientset kubernetes.Interface, namespace string) error {
+	start := time.Now()
+	_, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, v1.GetOptions{})
+	k8sRequestDuration.WithLabelValues("get_namespace").Observe(time.Since(start).Seconds())
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+
+	start = time.Now()
+	_, err = clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: v1.ObjectMeta{
+			Name:   namespace,
+			Labels: map[string]string{managedByLabel: managedByValue},
+		},
+	}, v1.CreateOptions{})
+	k8sRequestDuration.WithLabelValues("create_namespace").Observe(time.Since(start).Seconds())
+
+	// Another request may have created it in the meantime
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create namespace %s: %w", namespace, err)
+	}
+	slog.InfoContext(ctx, "Created namespace", "namespace", namespace)
+	return nil
+}
+
+func getCRDInKubernetes(ctx context.Context, dynamicClient dynamic.Interface, config Config, svcFriendlyIp string) (*IcanhazlbService, error) {
+	name := objectName(config, svcFriendlyIp)
+
+	start := time.Now()
+	object, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(config.Namespace).
+		Get(ctx, name, v1.GetOptions{})
+	k8sRequestDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CRD %s: %w", name, err)
+	}
+
+	icanhazlbService := &IcanhazlbService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), icanhazlbService); err != nil {
+		return nil, fmt.Errorf("failed to convert CRD %s: %v", name, err)
+	}
+
+	return icanhazlbService, nil
+}
+
+// errAmbiguousNamespace is returned by findCRDInAllNamespaces when more than
+// one namespace holds an IcanhazlbService for the IP
+var errAmbiguousNamespace = errors.New("IcanhazlbServices for the IP exist in several namespaces")
+
+// findCRDInAllNamespaces looks up the IcanhazlbService for svcFriendlyIp in
+// every namespace, returning a NotFound error if there is none
+func findCRDInAllNamespaces(ctx context.Context, dynamicClient dynamic.Interface, config Config, svcFriendlyIp string) (*IcanhazlbService, error) {
+	name := objectName(config, svcFriendlyIp)
+
+	start := time.Now()
+	list, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(v1.NamespaceAll).
+		List(ctx, v1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()})
+	k8sRequestDuration.WithLabelValues("list").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CRDs named %s: %w", name, err)
+	}
+
+	var found []unstructured.Unstructured
+	for _, item := range list.Items {
+		if item.GetName() == name {
+			found = append(found, item)
+		}
+	}
+	if len(found) == 0 {
+		return nil, apierrors.NewNotFound(icanhazlbServiceGVR.GroupResource(), name)
+	}
+	if len(found) > 1 {
+		namespaces := make([]string, 0, len(found))
+		for _, item := range found {
+			namespaces = append(namespaces, item.GetNamespace())
+		}
+		return nil, fmt.Errorf("%w: %s", errAmbiguousNamespace, strings.Join(namespaces, ", "))
+	}
+
+	icanhazlbService := &IcanhazlbService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(found[0].UnstructuredContent(), icanhazlbService); err != nil {
+		return nil, fmt.Errorf("failed to convert CRD %s: %v", name, err)
+	}
+	return icanhazlbService, nil
+}
+
+func listCRDsInKubernetes(ctx context.Context, dynamicClient dynamic.Interface, config Config) ([]IcanhazlbService, error) {
+	start := time.Now()
+	list, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(config.Namespace).
+		List(ctx, v1.ListOptions{})
+	k8sRequestDuration.WithLabelValues("list").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CRDs: %w", err)
+	}
+
+	icanhazlbServices := make([]IcanhazlbService, 0, len(list.Items))
+	for _, item := range list.Items {
+		var icanhazlbService IcanhazlbService
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &icanhazlbService); err != nil {
+			return nil, fmt.Errorf("failed to convert CRD %s: %v", item.GetName(), err)
+		}
+		icanhazlbServices = append(icanhazlbServices, icanhazlbService)
+	}
+
+	return icanhazlbServices, nil
 }
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+// testConfig returns the configuration the flags default to, for tests to
+// adjust before passing it to newTestHandler
+func testConfig() Config {
+	return Config{
+		ReadHeaderTimeout:  defaultReadHeaderTimeout,
+		ReadTimeout:        defaultReadTimeout,
+		WriteTimeout:       defaultWriteTimeout,
+		IdleTimeout:        defaultIdleTimeout,
+		MaxHeaderBytes:     http.DefaultMaxHeaderBytes,
+		MaxBodyBytes:       defaultMaxBodyBytes,
+		MaxHostnameLength:  validation.DNS1123SubdomainMaxLength,
+		Namespace:          defaultNamespace,
+		ResolveFQDNTimeout: defaultResolveTimeout,
+		DefaultPort:        defaultPort,
+		DefaultPortName:    defaultPortName,
+		ServiceType:        defaultServiceType,
+		K8sTimeout:         defaultK8sTimeout,
+		IngressClassName:   defaultIngressClass,
+		NamePrefix:         defaultNamePrefix,
+		DefaultPath:        defaultPath,
+		DefaultPathType:    defaultPathType,
+		IPFamilyPolicy:     defaultIPFamilyPolicy,
+		AsyncWorkers:       defaultAsyncWorkers,
+		AsyncQueueSize:     defaultAsyncQueueSize,
+		IPLabelPosition:    ipLabelAnywhere,
+		CreateIngress:      true,
+		K8sQPS:             float64(rest.DefaultQPS),
+		K8sBurst:           rest.DefaultBurst,
+		BulkMaxEntries:     defaultBulkMaxEntries,
+	}
+}
+
+// newTestHandler validates and prepares config, then returns the API's
+// routes backed by fake clients holding objects
+func newTestHandler(t *testing.T, config Config, objects ...runtime.Object) (http.Handler, *dynamicfake.FakeDynamicClient) {
+	t.Helper()
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+	if err := prepareConfig(&config); err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		icanhazlbServiceGVR: "IcanhazlbServiceList",
+	}, objects...)
+
+	store := newConfigStore(config)
+	recorder := &record.FakeRecorder{}
+	var createGroup singleflight.Group
+	creator := newAsyncCreator(dynamicClient, recorder, store, &createGroup, config.AsyncWorkers, config.AsyncQueueSize)
+	t.Cleanup(creator.shutdown)
+
+	var draining atomic.Bool
+	return createHandler(fake.NewSimpleClientset(), dynamicClient, recorder, store, &createGroup, creator, &draining), dynamicClient
+}
+
+// serveTestRequest sends a request for target with the given Host header
+// through handler and returns the recorded response
+func serveTestRequest(handler http.Handler, method, target, host string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if host != "" {
+		r.Host = host
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCRDHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		host       string
+		configure  func(*Config)
+		existing   bool
+		wantCode   int
+		wantStatus string
+	}{
+		{name: "create", method: http.MethodGet, target: "/", host: "10-0-0-5.example.com", wantCode: http.StatusOK, wantStatus: "created"},
+		{name: "create with POST", method: http.MethodPost, target: "/", host: "10-0-0-5.example.com", wantCode: http.StatusOK, wantStatus: "created"},
+		{name: "update existing", method: http.MethodGet, target: "/", host: "10-0-0-5.example.com", existing: true, wantCode: http.StatusOK, wantStatus: "updated"},
+		{name: "path hostname", method: http.MethodGet, target: "/ip/10-0-0-5.example.com", host: "api.example.com", wantCode: http.StatusOK, wantStatus: "created"},
+		{name: "delete existing", method: http.MethodDelete, target: "/", host: "10-0-0-5.example.com", existing: true, wantCode: http.StatusOK, wantStatus: "deleted"},
+		{name: "delete missing", method: http.MethodDelete, target: "/", host: "10-0-0-5.example.com", wantCode: http.StatusNotFound},
+		{name: "method not allowed", method: http.MethodPut, target: "/", host: "10-0-0-5.example.com", wantCode: http.StatusMethodNotAllowed},
+		{name: "alias in base domain", method: http.MethodGet, target: "/?aliases=www.example.com", host: "10-0-0-5.example.com", configure: withBaseDomain, wantCode: http.StatusOK, wantStatus: "created"},
+		{name: "alias outside base domain", method: http.MethodGet, target: "/?aliases=evil.attacker.net", host: "10-0-0-5.example.com", configure: withBaseDomain, wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			if tt.configure != nil {
+				tt.configure(&config)
+			}
+			handler, _ := newTestHandler(t, config)
+			if tt.existing {
+				if w := serveTestRequest(handler, http.MethodGet, "/", tt.host); w.Code != http.StatusOK {
+					t.Fatalf("creating existing object: got %d: %s", w.Code, w.Body)
+				}
+			}
+
+			w := serveTestRequest(handler, tt.method, tt.target, tt.host)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+				t.Errorf("got Content-Type %q, want JSON", w.Header().Get("Content-Type"))
+			}
+
+			var body map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+			}
+			if tt.wantStatus != "" && body["status"] != tt.wantStatus {
+				t.Errorf("got status %v, want %q", body["status"], tt.wantStatus)
+			}
+			if tt.wantCode >= http.StatusBadRequest && body["error"] == nil {
+				t.Errorf("error response has no error message: %v", body)
+			}
+		})
+	}
+}
+
+func TestCRDHandlerCreatesObject(t *testing.T) {
+	handler, dynamicClient := newTestHandler(t, testConfig())
+
+	w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	icanhazlbService := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5")
+	if got := icanhazlbService.Spec.EndpointSlices.Endpoints[0].Addresses; len(got) != 1 || got[0] != "10.0.0.5" {
+		t.Errorf("got endpoint addresses %v, want [10.0.0.5]", got)
+	}
+}
+
+func TestCRDHandlerRejectsHostnameWithoutIP(t *testing.T) {
+	handler, dynamicClient := newTestHandler(t, testConfig())
+
+	w := serveTestRequest(handler, http.MethodGet, "/", "foo.example.com")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		t.Errorf("got Content-Type %q, want JSON", got)
+	}
+
+	var body struct {
+		Error  string       `json:"error"`
+		Code   int          `json:"code"`
+		Errors []fieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+	}
+	if body.Code != http.StatusBadRequest || body.Error == "" {
+		t.Errorf("got error %q with code %d, want a message with code %d", body.Error, body.Code, http.StatusBadRequest)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Field != "host" || !strings.Contains(body.Errors[0].Message, "foo.example.com") {
+		t.Errorf("got field errors %+v, want one for the host naming foo.example.com", body.Errors)
+	}
+
+	// Nothing may be created for a hostname without an IP
+	list, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(defaultNamespace).List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("got %d objects created, want none", len(list.Items))
+	}
+}
+
+// getTestService returns the IcanhazlbService named name from the fake
+// dynamic client, failing the test if it doesn't exist
+func getTestService(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient, name string) IcanhazlbService {
+	t.Helper()
+	object, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(defaultNamespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("object not created: %v", err)
+	}
+	var icanhazlbService IcanhazlbService
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), &icanhazlbService); err != nil {
+		t.Fatal(err)
+	}
+	return icanhazlbService
+}
+
+func TestRequestAnnotations(t *testing.T) {
+	const snippet = "nginx.ingress.kubernetes.io/configuration-snippet"
+	const vhost = "nginx.ingress.kubernetes.io/upstream-vhost"
+	const timeout = "nginx.ingress.kubernetes.io/proxy-read-timeout"
+
+	config := testConfig()
+	config.UpstreamVhost = "backend.internal"
+	config.AllowedAnnotations = []string{timeout, vhost}
+	handler, dynamicClient := newTestHandler(t, config)
+
+	// Annotations must be key:value pairs
+	w := serveTestRequest(handler, http.MethodGet, "/?annotation="+timeout, "10-0-0-5.example.com")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d for an annotation without a value, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+
+	// Keys outside the allowlist are refused
+	w = serveTestRequest(handler, http.MethodGet, "/?annotation="+snippet+":return+200", "10-0-0-5.example.com")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d for %s, want %d: %s", w.Code, snippet, http.StatusBadRequest, w.Body)
+	}
+
+	// Allowed keys are added, but never replace the operator's
+	w = serveTestRequest(handler, http.MethodGet, "/?annotation="+timeout+":120&annotation="+vhost+":evil.example.net", "10-0-0-5.example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	annotations := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5").Spec.Ingresses.Annotations
+	if got := annotations[timeout]; got != "120" {
+		t.Errorf("got %s %q, want %q", timeout, got, "120")
+	}
+	if got := annotations[vhost]; got != "backend.internal" {
+		t.Errorf("got %s %q, want the configured %q", vhost, got, "backend.internal")
+	}
+}
+
+func TestServeAddressInUse(t *testing.T) {
+	first := httptest.NewServer(http.NotFoundHandler())
+	defer first.Close()
+
+	second := &http.Server{Addr: first.Listener.Addr().String(), Handler: http.NotFoundHandler()}
+	err := serve(second, "", "")
+	if err == nil {
+		second.Close()
+		t.Fatal("second server on the same address started, want an error")
+	}
+	if !strings.Contains(err.Error(), "address already in use") {
+		t.Errorf("got error %v, want address already in use", err)
+	}
+
+	// The first server keeps serving
+	resp, err := http.Get(first.URL)
+	if err != nil {
+		t.Fatalf("first server stopped serving: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestServeShutdown(t *testing.T) {
+	server := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	done := make(chan error, 1)
+	go func() { done <- serve(server, "", "") }()
+
+	// Shutting down before or while serving must not be reported as a failure
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %v after shutdown, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after shutdown")
+	}
+}
+
+func TestParseIPAddressFromHostname(t *testing.T) {
+	tests := []struct {
+		hostname    string
+		want        string
+		wantErr     bool
+		wantErrText string
+	}{
+		{hostname: "10-0-0-5.example.com", want: "10.0.0.5"},
+		{hostname: "10.0.0.5.example.com", want: "10.0.0.5"},
+		{hostname: "10_0_0_5.example.com", want: "10.0.0.5"},
+		{hostname: "2001-db8--1.example.com", want: "2001:db8::1"},
+		{hostname: "2001-0db8-0000-0000-0000-0000-0000-0001.example.com", want: "2001:db8::1"},
+		{hostname: "fe80--1.example.com", want: "fe80::1"},
+		{hostname: "--1.example.com", want: "::1"},
+		// Octets must be within 0-255
+		{hostname: "0-0-0-0.example.com", want: "0.0.0.0"},
+		{hostname: "255-255-255-255.example.com", want: "255.255.255.255"},
+		{hostname: "10-0-0-255.example.com", want: "10.0.0.255"},
+		{hostname: "256-1-1-1.example.com", wantErr: true, wantErrText: "out of range 0-255"},
+		{hostname: "10-0-0-256.example.com", wantErr: true, wantErrText: "out of range 0-255"},
+		{hostname: "300-1-1-1.example.com", wantErr: true, wantErrText: "out of range 0-255"},
+		{hostname: "999.999.999.999.example.com", wantErr: true, wantErrText: "out of range 0-255"},
+		// IPv4-mapped IPv6 addresses parse, but as IPv4 rather than IPv6, so
+		// they're refused instead of being returned in either form
+		{hostname: "--ffff-a00-5.example.com", wantErr: true},
+		{hostname: "0--ffff-a00-5.example.com", wantErr: true},
+		// Literal IPv6 addresses aren't valid in hostnames
+		{hostname: "2001:db8::1", wantErr: true},
+		{hostname: "::ffff:10.0.0.5", wantErr: true},
+		{hostname: "foo.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got, err := parseIPAddressFromHostname(tt.hostname, ipLabelAnywhere)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrText) {
+				t.Errorf("got error %q, want it to mention %q", err, tt.wantErrText)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func withBaseDomain(config *Config) { config.BaseDomain = "example.com" }
+
+func TestBaseDomain(t *testing.T) {
+	tests := []struct {
+		host     string
+		wantCode int
+	}{
+		{host: "10-0-0-5.example.com", wantCode: http.StatusOK},
+		{host: "10-0-0-5.EXAMPLE.com.", wantCode: http.StatusOK},
+		{host: "10-0-0-5.example.com.attacker.net", wantCode: http.StatusForbidden},
+		{host: "10-0-0-5.notexample.com", wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			config := testConfig()
+			withBaseDomain(&config)
+			handler, _ := newTestHandler(t, config)
+
+			if w := serveTestRequest(handler, http.MethodGet, "/", tt.host); w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestPathHostname(t *testing.T) {
+	handler, dynamicClient := newTestHandler(t, testConfig())
+
+	// The path names the host even when the Host header has no IP
+	w := serveTestRequest(handler, http.MethodGet, "/ip/10-0-0-5.example.com", "api.example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	rules := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5").Spec.Ingresses.Rules
+	if len(rules) != 1 || rules[0].Host != "10-0-0-5.example.com" {
+		t.Errorf("got ingress rules %+v, want one for 10-0-0-5.example.com", rules)
+	}
+
+	if w := serveTestRequest(handler, http.MethodGet, "/ip/foo.example.com", "10-0-0-6.example.com"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a path hostname without an IP, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
+
+func TestServiceNameLabelMatchesService(t *testing.T) {
+	tests := []struct {
+		name       string
+		namePrefix string
+		template   string
+		object     string
+		want       string
+	}{
+		{name: "default", namePrefix: defaultNamePrefix, object: "icanhazlb-10-0-0-5", want: "icanhazlb-10-0-0-5-svc"},
+		{name: "name prefix", namePrefix: "lb", object: "lb-10-0-0-5", want: "lb-10-0-0-5-svc"},
+		{name: "template", namePrefix: defaultNamePrefix, template: "{{ .Name }}-backend", object: "icanhazlb-10-0-0-5", want: "icanhazlb-10-0-0-5-backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.NamePrefix = tt.namePrefix
+			config.ServiceNameTemplate = tt.template
+			handler, dynamicClient := newTestHandler(t, config)
+
+			if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.example.com"); w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+
+			spec := getTestService(t, dynamicClient, tt.object).Spec
+			if spec.Services.Name != tt.want {
+				t.Errorf("got service name %q, want %q", spec.Services.Name, tt.want)
+			}
+			if got := spec.EndpointSlices.Labels["kubernetes.io/service-name"]; got != spec.Services.Name {
+				t.Errorf("got service-name label %q, want the service name %q", got, spec.Services.Name)
+			}
+			if got := spec.Ingresses.Rules[0].HTTP.Paths[0].Backend.Service.Name; got != spec.Services.Name {
+				t.Errorf("got ingress backend %q, want the service name %q", got, spec.Services.Name)
+			}
+		})
+	}
+}
+
+func TestServiceLimit(t *testing.T) {
+	config := testConfig()
+	config.MaxServices = 1
+	handler, _ := newTestHandler(t, config)
+
+	if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.example.com"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for the first service: %s", w.Code, w.Body)
+	}
+
+	w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-6.example.com")
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("got status %d over the limit, want %d: %s", w.Code, http.StatusInsufficientStorage, w.Body)
+	}
+	var body struct {
+		Count int `json:"count"`
+		Limit int `json:"limit"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+	}
+	if body.Count != 1 || body.Limit != 1 {
+		t.Errorf("got count %d and limit %d, want 1 and 1", body.Count, body.Limit)
+	}
+
+	// Updating the existing object doesn't add another
+	if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.example.com"); w.Code != http.StatusOK {
+		t.Errorf("got status %d updating the existing service: %s", w.Code, w.Body)
+	}
+}
+
+func TestFindIPv4(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     string
+		wantPort int
+	}{
+		{hostname: "app-10-0-0-5.example.com", want: "10-0-0-5"},
+		{hostname: "app1-10-0-0-5.example.com", want: "10-0-0-5"},
+		{hostname: "1234-10-0-0-5.example.com", want: "10-0-0-5"},
+		{hostname: "10-0-0-5-app.example.com", want: "10-0-0-5"},
+		{hostname: "10-0-0-5-8080.example.com", want: "10-0-0-5", wantPort: 8080},
+		{hostname: "app-10-0-0-5-8080.example.com", want: "10-0-0-5", wantPort: 8080},
+		{hostname: "10_0_0_5_8080.example.com", want: "10_0_0_5", wantPort: 8080},
+		{hostname: "1.2.3.4.5", want: "1.2.3.4"},
+		{hostname: "www.10.0.0.5.example.com", want: "10.0.0.5"},
+		{hostname: "app-10-0-0.example.com", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got, start := findIPv4(tt.hostname)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if got != "" && tt.hostname[start:start+len(got)] != got {
+				t.Errorf("got offset %d, which doesn't point at %q", start, got)
+			}
+			if got == "" && start != -1 {
+				t.Errorf("got offset %d without a match, want -1", start)
+			}
+			if port := parsePortFromHostname(context.Background(), tt.hostname); port != tt.wantPort {
+				t.Errorf("got port %d, want %d", port, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestServiceLimitAcrossNamespaces(t *testing.T) {
+	config := testConfig()
+	config.MaxServices = 1
+	config.NamespaceRegex = `^[^.]+\.([a-z]+)\.`
+	handler, dynamicClient := newTestHandler(t, config)
+
+	if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.teama.example.com"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for the first service: %s", w.Code, w.Body)
+	}
+	if _, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace("teama").Get(context.Background(), "icanhazlb-10-0-0-5", v1.GetOptions{}); err != nil {
+		t.Fatalf("first service not created in its namespace: %v", err)
+	}
+
+	// Another namespace doesn't get a limit of its own
+	if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-6.teamb.example.com"); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("got status %d in another namespace, want %d: %s", w.Code, http.StatusInsufficientStorage, w.Body)
+	}
+
+	// Updating the existing object doesn't add another
+	if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.teama.example.com"); w.Code != http.StatusOK {
+		t.Errorf("got status %d updating the existing service: %s", w.Code, w.Body)
+	}
+}
+
+func TestPathHostnameUnderBaseDomain(t *testing.T) {
+	for _, target := range []string{"/ip/10-0-0-5", "/ip/10.0.0.5", "/ip/10-0-0-5.example.com"} {
+		t.Run(target, func(t *testing.T) {
+			config := testConfig()
+			withBaseDomain(&config)
+			handler, dynamicClient := newTestHandler(t, config)
+
+			w := serveTestRequest(handler, http.MethodGet, target, "api.example.com")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			rules := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5").Spec.Ingresses.Rules
+			if len(rules) != 1 || rules[0].Host != "10-0-0-5.example.com" {
+				t.Errorf("got ingress rules %+v, want one for 10-0-0-5.example.com", rules)
+			}
+		})
+	}
+}
+
+func TestBareHostname(t *testing.T) {
+	tests := []struct {
+		hostname   string
+		baseDomain string
+		want       string
+	}{
+		{hostname: "10-0-0-5", baseDomain: "example.com", want: "10-0-0-5.example.com"},
+		{hostname: "10.0.0.5", baseDomain: "example.com", want: "10-0-0-5.example.com"},
+		{hostname: "2001:db8::1", baseDomain: ".example.com.", want: "2001-db8--1.example.com"},
+		{hostname: "10-0-0-5.other.net", baseDomain: "example.com", want: "10-0-0-5.other.net"},
+		{hostname: "10.0.0.5", want: "10-0-0-5"},
+		{hostname: "10-0-0-5", want: "10-0-0-5"},
+	}
+
+	for _, tt := range tests {
+		if got := bareHostname(tt.hostname, tt.baseDomain); got != tt.want {
+			t.Errorf("bareHostname(%q, %q) = %q, want %q", tt.hostname, tt.baseDomain, got, tt.want)
+		}
+	}
+}
+
+func TestFQDNBackendNames(t *testing.T) {
+	// Unresolved FQDN backends are only allowed without IP restrictions
+	config := testConfig()
+	config.AllowSpecialIPs = true
+	handler, dynamicClient := newTestHandler(t, config)
+
+	if w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.example.com"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for the IP backend: %s", w.Code, w.Body)
+	}
+
+	// A dash-encoded IP given as an FQDN would otherwise take over the IP
+	// backend's objects
+	for _, fqdn := range []string{"10-0-0-5", "2001-db8--1"} {
+		if w := serveTestRequest(handler, http.MethodGet, "/?fqdn="+fqdn, "app.example.com"); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for fqdn=%s, want %d: %s", w.Code, fqdn, http.StatusBadRequest, w.Body)
+		}
+	}
+
+	if w := serveTestRequest(handler, http.MethodGet, "/?fqdn=backend.example.net", "app.example.com"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d for the FQDN backend: %s", w.Code, w.Body)
+	}
+	spec := getTestService(t, dynamicClient, "icanhazlb-fqdn-backend-example-net").Spec
+	if spec.EndpointSlices.AddressType != "FQDN" || spec.Services.Name != "icanhazlb-fqdn-backend-example-net-svc" {
+		t.Errorf("got address type %q and service %q, want an FQDN slice behind icanhazlb-fqdn-backend-example-net-svc", spec.EndpointSlices.AddressType, spec.Services.Name)
+	}
+
+	// The IP backend is untouched
+	rules := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5").Spec.Ingresses.Rules
+	if len(rules) != 1 || rules[0].Host != "10-0-0-5.example.com" {
+		t.Errorf("got IP backend ingress rules %+v, want its own", rules)
+	}
+}
+
+func TestFQDNBackendIPRestrictions(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		fqdn      string
+		wantCode  int
+	}{
+		{name: "special IPs blocked", fqdn: "backend.example.net", wantCode: http.StatusForbidden},
+		{name: "denied CIDRs", configure: func(c *Config) { c.AllowSpecialIPs, c.DenyCIDRs = true, []string{"10.0.0.0/8"} }, fqdn: "backend.example.net", wantCode: http.StatusForbidden},
+		{name: "allowed CIDRs", configure: func(c *Config) { c.AllowSpecialIPs, c.AllowCIDRs = true, []string{"10.0.0.0/8"} }, fqdn: "backend.example.net", wantCode: http.StatusForbidden},
+		{name: "unrestricted", configure: func(c *Config) { c.AllowSpecialIPs = true }, fqdn: "backend.example.net", wantCode: http.StatusOK},
+		// Resolved addresses are checked like any other backend IP
+		{name: "resolved to loopback", configure: func(c *Config) { c.ResolveFQDN = true }, fqdn: "localhost", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			if tt.configure != nil {
+				tt.configure(&config)
+			}
+			handler, _ := newTestHandler(t, config)
+
+			if w := serveTestRequest(handler, http.MethodGet, "/?fqdn="+tt.fqdn, "app.example.com"); w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestServicesAcrossNamespaces(t *testing.T) {
+	config := testConfig()
+	config.NamespaceRegex = `^[^.]+\.([a-z]+)\.`
+	handler, dynamicClient := newTestHandler(t, config)
+
+	for _, host := range []string{"10-0-0-5.teama.example.com", "10-0-0-6.teamb.example.com", "10-0-0-6.teama.example.com"} {
+		if w := serveTestRequest(handler, http.MethodGet, "/", host); w.Code != http.StatusOK {
+			t.Fatalf("got status %d creating %s: %s", w.Code, host, w.Body)
+		}
+	}
+
+	w := serveTestRequest(handler, http.MethodGet, "/services", "api.example.com")
+	var services []map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &services); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+	}
+	if len(services) != 3 {
+		t.Errorf("got %d services listed, want all 3 across namespaces: %v", len(services), services)
+	}
+
+	// An IP used in a single namespace is found there
+	w = serveTestRequest(handler, http.MethodGet, "/services/10-0-0-5", "api.example.com")
+	var service struct {
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &service); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+	}
+	if w.Code != http.StatusOK || service.Namespace != "teama" {
+		t.Errorf("got status %d in namespace %q, want %d in teama: %s", w.Code, service.Namespace, http.StatusOK, w.Body)
+	}
+
+	// One used in several can't be picked
+	if w := serveTestRequest(handler, http.MethodGet, "/services/10-0-0-6", "api.example.com"); w.Code != http.StatusConflict {
+		t.Errorf("got status %d for an IP in two namespaces, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	if w := serveTestRequest(handler, http.MethodGet, "/services/10-0-0-7", "api.example.com"); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown IP, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+
+	// The garbage collector, given every namespace as with a namespace
+	// regex, deletes from each of them
+	if err := collectExpiredServices(context.Background(), dynamicClient, v1.NamespaceAll, config.NamePrefix, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	list, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(v1.NamespaceAll).List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("got %d objects left after garbage collection, want none", len(list.Items))
+	}
+}
+
+func TestCRDHandlerRejectsInvalidName(t *testing.T) {
+	handler, dynamicClient := newTestHandler(t, testConfig())
+
+	// 2001:db8:: would be named icanhazlb-2001-db8--, which ends in a dash
+	w := serveTestRequest(handler, http.MethodGet, "/", "2001-db8--.example.com")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	var body struct {
+		Errors []fieldError `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Field != "host" {
+		t.Errorf("got field errors %+v, want one for the host", body.Errors)
+	}
+
+	list, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(defaultNamespace).List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Errorf("got %d objects created, want none", len(list.Items))
+	}
+
+	// A leading :: is fine, as the prefix comes first
+	if w := serveTestRequest(handler, http.MethodGet, "/", "--2001-db8.example.com"); w.Code != http.StatusOK {
+		t.Errorf("got status %d for ::2001:db8, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestCollapseSubdomainsKeepsRules(t *testing.T) {
+	config := testConfig()
+	config.CollapseSubdomains = true
+	handler, dynamicClient := newTestHandler(t, config)
+
+	want := []string{"*.10-0-0-5.example.com", "10-0-0-5.example.com"}
+	// The rules must not flip between the bare and wildcard host as
+	// requests for either come in
+	for _, host := range []string{"www.10-0-0-5.example.com", "10-0-0-5.example.com", "api.10-0-0-5.example.com"} {
+		w := serveTestRequest(handler, http.MethodGet, "/", host)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", host, w.Code, w.Body)
+		}
+
+		icanhazlbService := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5")
+		var got []string
+		for _, rule := range icanhazlbService.Spec.Ingresses.Rules {
+			got = append(got, rule.Host)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got rule hosts %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestBulkMaxEntries(t *testing.T) {
+	config := testConfig()
+	config.BulkMaxEntries = 2
+	handler, dynamicClient := newTestHandler(t, config)
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`[{"ip":"10.0.0.5"},{"ip":"10.0.0.6"},{"ip":"10.0.0.7"}]`, http.StatusRequestEntityTooLarge},
+		{`[{"ip":"10.0.0.5"},{"ip":"10.0.0.6"}]`, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Fatalf("%s: got status %d, want %d: %s", tt.body, w.Code, tt.want, w.Body)
+		}
+	}
+
+	// Only the request within the limit may create anything
+	list, err := dynamicClient.Resource(icanhazlbServiceGVR).Namespace(defaultNamespace).List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 {
+		t.Errorf("got %d objects, want 2", len(list.Items))
+	}
+}
+
+func TestConfiguredAnnotationsWin(t *testing.T) {
+	config := testConfig()
+	config.BackendProtocol = "GRPC"
+	config.UpstreamVhost = "backend.internal"
+	config.IngressAnnotations = map[string]string{
+		backendProtocolAnnotation: "HTTPS",
+		upstreamVhostAnnotation:   "{{ .Hostname }}",
+	}
+	handler, dynamicClient := newTestHandler(t, config)
+
+	w := serveTestRequest(handler, http.MethodGet, "/", "10-0-0-5.example.com")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	annotations := getTestService(t, dynamicClient, "icanhazlb-10-0-0-5").Spec.Ingresses.Annotations
+	if got := annotations[backendProtocolAnnotation]; got != "HTTPS" {
+		t.Errorf("got %s %q, want the configured %q", backendProtocolAnnotation, got, "HTTPS")
+	}
+	if got := annotations[upstreamVhostAnnotation]; got != "10-0-0-5.example.com" {
+		t.Errorf("got %s %q, want the configured %q", upstreamVhostAnnotation, got, "10-0-0-5.example.com")
+	}
+}
+
+func TestRateLimitForwardedClients(t *testing.T) {
+	config := testConfig()
+	config.RateLimit = 1
+	config.RateBurst = 1
+	config.TrustForwardedHeaders = true
+	handler, _ := newTestHandler(t, config)
+
+	// Clients behind the same trusted proxy are limited separately
+	for _, tt := range []struct {
+		forwardedFor string
+		want         int
+	}{
+		{"192.0.2.1", http.StatusOK},
+		{"192.0.2.2", http.StatusOK},
+		{"192.0.2.1", http.StatusTooManyRequests},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = "10-0-0-5.example.com"
+		r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d: %s", tt.forwardedFor, w.Code, tt.want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "icanhazlb_requests_total",
+			Help: "Total number of requests received by the catch-all handler.",
+		},
+		[]string{"method"},
+	)
+
+	crdCreationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "icanhazlb_crd_creations_total",
+			Help: "Total number of IcanhazlbService objects successfully created, by ingress class and namespace.",
+		},
+		[]string{"ingress_class", "namespace"},
+	)
+
+	crdFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "icanhazlb_crd_failures_total",
+			Help: "Total number of failed IcanhazlbService operations, by reason, ingress class and namespace.",
+		},
+		[]string{"reason", "ingress_class", "namespace"},
+	)
+
+	k8sRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "icanhazlb_k8s_request_duration_seconds",
+			Help:    "Latency of Kubernetes API calls, by operation.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"operation"},
+	)
+)
+
+// crdMetricLabels returns the ingress class and namespace labels of the CRD
+// counters. They only ever take configured values, so the namespace is the
+// configured one even for requests that pick their own.
+func crdMetricLabels(config Config) prometheus.Labels {
+	return prometheus.Labels{
+		"ingress_class": config.IngressClassName,
+		"namespace":     config.metricsNamespace,
+	}
+}
+
+func registerMetrics() {
+	prometheus.MustRegister(
+		requestsTotal,
+		crdCreationsTotal,
+		crdFailuresTotal,
+		k8sRequestDuration,
+	)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader  = "X-Request-ID"
+	corsAllowHeaders = "Authorization, Content-Type, X-Request-ID"
+)
+
+// Incoming request IDs end up in our logs, so only accept simple ones
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// withRequestID tags each request with the caller's X-Request-ID, or a
+// generated UUID when absent, and echoes it back in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// withMaxBodyBytes limits request bodies to maxBytes so oversized uploads
+// fail instead of being read into memory
+func withMaxBodyBytes(next http.Handler, maxBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Probes are made by the kubelet, which doesn't have the token
+var unauthenticatedPaths = []string{"/healthz", "/readyz"}
+
+// withBearerAuth rejects requests without the configured bearer token in
+// their Authorization header. Authentication is disabled when no token is
+// configured.
+func withBearerAuth(next http.Handler, store *configStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := store.get().AuthToken
+		if token == "" || containsString(unauthenticatedPaths, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		provided, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			slog.WarnContext(r.Context(), "Rejected unauthenticated request", "method", r.Method, "path", r.URL.Path, "outcome", "unauthorized")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCORS lets browsers on the allowed origins call the API, answering
+// preflight requests itself. It does nothing when no origins are allowed.
+func withCORS(next http.Handler, store *configStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowedOrigins := store.get().AllowedOrigins
+		if origin == "" || !(containsString(allowedOrigins, origin) || containsString(allowedOrigins, "*")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withGzip compresses JSON responses of at least the configured size for
+// clients that accept gzip. Smaller responses aren't worth the overhead and
+// are sent as they are.
+func withGzip(next http.Handler, store *configStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minBytes := store.get().GzipMinBytes
+		if minBytes == 0 || r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minBytes: minBytes, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+
+		// A zero quality value means the coding is not acceptable
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether
+// the response is large enough to compress
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	status   int
+	buffer   []byte
+
+	// decided is set once the headers are sent, with gz set if the rest of
+	// the response is compressed
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	if w.decided {
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buffer = append(w.buffer, p...)
+	if len(w.buffer) >= w.minBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the headers and buffered body, compressing them when the
+// response is large enough and is JSON that isn't already encoded
+func (w *gzipResponseWriter) decide(large bool) error {
+	w.decided = true
+	header := w.Header()
+	compress := large &&
+		header.Get("Content-Encoding") == "" &&
+		strings.HasPrefix(header.Get("Content-Type"), "application/json") &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified
+
+	if compress {
+		// The length set by the handler is for the uncompressed body
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		header.Add("Vary", "Accept-Encoding")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	if w.gz != nil {
+		_, err := w.gz.Write(buffer)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buffer)
+	return err
+}
+
+// close sends any response still buffered and finishes the compressed body
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// withAccessLog logs every request with its response status and latency
+// when the access log is enabled
+func withAccessLog(next http.Handler, store *configStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := store.get()
+		if !config.AccessLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		hostname := requestedHostname(r, config)
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"host", hostname,
+			"status", recorder.status,
+			"latency", time.Since(start),
+		}
+		if checkHostnameLimits(config, hostname) == nil {
+			if ip, err := parseIPAddressFromHostname(hostname, config.IPLabelPosition); err == nil {
+				attrs = append(attrs, "ip", ip)
+			}
+		}
+		slog.InfoContext(r.Context(), "Handled request", attrs...)
+	})
+}
+
+// statusRecorder captures the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/retry"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// webhookNotification is the JSON payload posted to the notify webhook when
+// an IcanhazlbService is created
+type webhookNotification struct {
+	Hostname  string    `json:"hostname"`
+	IPAddress string    `json:"ipAddress"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// pendingNotifications tracks webhook deliveries still in flight so they
+// can finish before the process exits
+var pendingNotifications sync.WaitGroup
+
+// notifyWebhook posts notification to url in the background, retrying
+// failures. Errors are only logged, as the request has already succeeded.
+func notifyWebhook(ctx context.Context, url string, notification webhookNotification) {
+	// Outlive the request while keeping its ID for the logs
+	ctx = context.WithoutCancel(ctx)
+
+	pendingNotifications.Add(1)
+	go func() {
+		defer pendingNotifications.Done()
+
+		body, err := json.Marshal(notification)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to encode webhook notification", "error", err)
+			return
+		}
+
+		err = retry.OnError(retry.DefaultBackoff, func(error) bool { return true }, func() error {
+			return postWebhook(ctx, url, body)
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to notify webhook", "name", notification.Name, "error", err)
+			return
+		}
+		slog.DebugContext(ctx, "Notified webhook", "name", notification.Name)
+	}()
+}
+
+func postWebhook(ctx context.Context, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+)
+
+// resolvedOwner is the owner reference set on created IcanhazlbServices so
+// the cluster garbage collects them along with their owner
+type resolvedOwner struct {
+	reference  v1.OwnerReference
+	namespaced bool
+	namespace  string
+}
+
+// ownerReferencesFor returns the owner references for an object in
+// namespace. Namespaced owners can only own objects in their own namespace.
+func (o *resolvedOwner) ownerReferencesFor(namespace string) []v1.OwnerReference {
+	if o == nil || (o.namespaced && o.namespace != namespace) {
+		return nil
+	}
+	return []v1.OwnerReference{o.reference}
+}
+
+// resolveOwner looks up the configured owner, in the configured namespace
+// if it is namespaced, to get the UID its owner reference needs
+func resolveOwner(ctx context.Context, discoveryClient discovery.DiscoveryInterface, dynamicClient dynamic.Interface, config Config) (*resolvedOwner, error) {
+	groupVersion, err := schema.ParseGroupVersion(config.OwnerAPIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner API version %q: %v", config.OwnerAPIVersion, err)
+	}
+
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	mapping, err := mapper.RESTMapping(groupVersion.WithKind(config.OwnerKind).GroupKind(), groupVersion.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find owner kind %s: %v", config.OwnerKind, err)
+	}
+
+	owner := &resolvedOwner{namespaced: mapping.Scope.Name() == meta.RESTScopeNameNamespace}
+	resource := dynamicClient.Resource(mapping.Resource)
+	var object *unstructured.Unstructured
+	if owner.namespaced {
+		owner.namespace = config.Namespace
+		object, err = resource.Namespace(config.Namespace).Get(ctx, config.OwnerName, v1.GetOptions{})
+	} else {
+		object, err = resource.Get(ctx, config.OwnerName, v1.GetOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get owner %s %s: %v", config.OwnerKind, config.OwnerName, err)
+	}
+
+	owner.reference = v1.OwnerReference{
+		APIVersion: config.OwnerAPIVersion,
+		Kind:       config.OwnerKind,
+		Name:       config.OwnerName,
+		UID:        object.GetUID(),
+	}
+	return owner, nil
+}
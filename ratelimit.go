@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiterIdleTimeout is how long a client's limiter is kept after its
+// last request before being pruned
+const clientLimiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientRateLimiter keeps a token bucket per client key
+type clientRateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+func newClientRateLimiter(limit float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:     rate.Limit(limit),
+		burst:     burst,
+		clients:   map[string]*clientLimiter{},
+		lastPrune: time.Now(),
+	}
+}
+
+// allow reports whether the client identified by key may make a request
+// now, and if not, how long it should wait before retrying
+func (l *clientRateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > clientLimiterIdleTimeout {
+		for k, client := range l.clients {
+			if now.Sub(client.lastSeen) > clientLimiterIdleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = client
+	}
+	client.lastSeen = now
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
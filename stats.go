@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+)
+
+// In-memory counters served on /stats, a lighter-weight overview than
+// /metrics for ad-hoc checks
+var (
+	startTime      = time.Now()
+	requestsServed atomic.Int64
+	crdsCreated    atomic.Int64
+	activeServices atomic.Int64
+)
+
+// withRequestCount counts every request served
+func withRequestCount(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsServed.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seedActiveServices starts the active service count from the existing
+// objects with our name prefix, counted like checkServiceLimit does: in the
+// configured namespace, or in all of them with a namespace regex. It is best
+// effort, as the count is only an overview.
+func seedActiveServices(ctx context.Context, dynamicClient dynamic.Interface, config Config) {
+	config.Namespace = listNamespace(config)
+	icanhazlbServices, err := listCRDsInKubernetes(ctx, dynamicClient, config)
+	if err != nil {
+		slog.Warn("Failed to count existing IcanhazlbServices for /stats", "error", err)
+		return
+	}
+
+	count := 0
+	for _, icanhazlbService := range icanhazlbServices {
+		if strings.HasPrefix(icanhazlbService.Name, config.NamePrefix+"-") {
+			count++
+		}
+	}
+	activeServices.Store(int64(count))
+}
+
+// serveStats reports the uptime and counters as JSON
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	uptime := time.Since(startTime)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"startTime":      startTime.UTC().Format(time.RFC3339),
+		"uptime":         uptime.Round(time.Second).String(),
+		"uptimeSeconds":  int64(uptime.Seconds()),
+		"requestsServed": requestsServed.Load(),
+		"crdsCreated":    crdsCreated.Load(),
+		// Deletions by other instances can't be seen, so don't go negative
+		"activeServices": max(activeServices.Load(), 0),
+	})
+}
@@ -0,0 +1,15 @@
+package main
+
+// Build metadata, injected at build time with e.g.
+// -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2023-06-01T00:00:00Z"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// userAgent identifies our requests to the Kubernetes API server, e.g. in
+// its audit logs
+func userAgent() string {
+	return "icanhazlb-api/" + version
+}